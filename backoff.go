@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// backoff computes the delays between attempts to connect to a broker. The
+// delay doubles with every failure up to the maximum, and is randomised by
+// the jitter fraction so that many exporters don't reconnect in lockstep
+// after a broker restart.
+type backoff struct {
+	config   *ReconnectConfig
+	current  time.Duration
+	failures int
+}
+
+// newBackoff creates a backoff starting at the initial delay
+func newBackoff(cfg *ReconnectConfig) *backoff {
+	return &backoff{config: cfg}
+}
+
+// Next records a failed attempt and returns how long to wait before the next one
+func (b *backoff) Next() time.Duration {
+	b.failures++
+
+	switch {
+	case b.current == 0:
+		b.current = b.config.InitialBackoff.Duration
+	case b.current < b.config.MaxBackoff.Duration:
+		b.current = min(2*b.current, b.config.MaxBackoff.Duration)
+	}
+
+	if b.config.Jitter <= 0 {
+		return b.current
+	}
+
+	// Spread the delay evenly over current ± jitter
+	factor := 1 + b.config.Jitter*(2*rand.Float64()-1) //nolint:gosec // jitter doesn't need a secure source
+
+	return time.Duration(float64(b.current) * factor)
+}
+
+// Failures returns the number of failed attempts since the last Reset
+func (b *backoff) Failures() int {
+	return b.failures
+}
+
+// Reset starts over from the initial delay after a successful attempt
+func (b *backoff) Reset() {
+	b.current = 0
+	b.failures = 0
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// bridgeTopicPrefix is the $SYS subtree Mosquitto publishes bridge connection state under
+const bridgeTopicPrefix = "$SYS/broker/connection/"
+
+// bridgeMetricForTopic returns the metric a bridge topic is exported as and
+// the bridge name. Every per-connection value becomes a single metric family
+// with a bridge label: "state" is exported as mosquitto_bridge_up and any
+// other value as mosquitto_bridge_<value>.
+func bridgeMetricForTopic(topic string) (topicMetric, string, bool) {
+	rest, ok := strings.CutPrefix(topic, bridgeTopicPrefix)
+	if !ok {
+		return topicMetric{}, "", false
+	}
+
+	bridge, key, ok := strings.Cut(rest, "/")
+	if !ok || bridge == "" || key == "" {
+		return topicMetric{}, "", false
+	}
+
+	metric := topicMetric{
+		Name:        "mosquitto_bridge_" + parseTopic(key),
+		Help:        "The " + key + " value of the bridge connection.",
+		LabelNames:  []string{"bridge"},
+		LabelValues: []string{bridge},
+	}
+
+	if key == "state" {
+		metric.Name = "mosquitto_bridge_up"
+		metric.Help = "Whether the bridge connection is up (1 = connected, 0 = disconnected)."
+	}
+
+	return metric, bridge, true
+}
+
+// bridgeTracker remembers which bridges a broker has announced and the metric
+// families they were exported in, so their series can be removed once the
+// bridge disappears.
+//
+// Mosquitto only publishes bridge state when it changes, so a bridge is
+// considered gone when its retained state is cleared (an empty payload) or
+// when it isn't re-announced within the first full $SYS cycle after a reconnect.
+type bridgeTracker struct {
+	mu         sync.Mutex
+	generation int
+	uptimeSeen int
+	bridges    map[string]*trackedBridge
+	deleteFunc func(metricName string, labels prometheus.Labels)
+}
+
+// trackedBridge is a bridge seen on the broker, with the labels identifying
+// its series in each metric family it was exported in
+type trackedBridge struct {
+	generation int
+	metrics    map[string]prometheus.Labels
+}
+
+// newBridgeTracker creates a tracker that removes series with deleteFunc
+func newBridgeTracker(deleteFunc func(metricName string, labels prometheus.Labels)) *bridgeTracker {
+	return &bridgeTracker{
+		bridges:    make(map[string]*trackedBridge),
+		deleteFunc: deleteFunc,
+	}
+}
+
+// StartCycle marks all known bridges as unconfirmed after a (re)connect
+func (bt *bridgeTracker) StartCycle() {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	bt.generation++
+	bt.uptimeSeen = 0
+}
+
+// Seen records that the bridge was announced and exported in the given
+// metric family, in the series matching labels
+func (bt *bridgeTracker) Seen(bridge, metricName string, labels prometheus.Labels) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	tracked, ok := bt.bridges[bridge]
+	if !ok {
+		tracked = &trackedBridge{metrics: make(map[string]prometheus.Labels)}
+		bt.bridges[bridge] = tracked
+	}
+
+	tracked.generation = bt.generation
+	tracked.metrics[metricName] = labels
+}
+
+// Remove deletes all series of the bridge
+func (bt *bridgeTracker) Remove(bridge string) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	bt.remove(bridge)
+}
+
+// Uptime is called for every $SYS/broker/uptime message. The second one after
+// a reconnect marks the end of a full $SYS cycle, after which bridges that
+// weren't re-announced are removed.
+func (bt *bridgeTracker) Uptime() {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	bt.uptimeSeen++
+	if bt.uptimeSeen != 2 {
+		return
+	}
+
+	for bridge, tracked := range bt.bridges {
+		if tracked.generation < bt.generation {
+			bt.remove(bridge)
+		}
+	}
+}
+
+// remove deletes all series of the bridge. Must be called with bt.mu held.
+func (bt *bridgeTracker) remove(bridge string) {
+	tracked, ok := bt.bridges[bridge]
+	if !ok {
+		return
+	}
+
+	for metricName, labels := range tracked.metrics {
+		bt.deleteFunc(metricName, labels)
+	}
+
+	delete(bt.bridges, bridge)
+}
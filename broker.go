@@ -0,0 +1,979 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// brokerConnection manages the MQTT connection to a single Mosquitto broker
+// and turns its $SYS messages into metrics carrying the broker's labels
+type brokerConnection struct {
+	config      *BrokerConfig
+	settings    *MosquittoConfig
+	backoff     *backoff
+	metrics     *MosquittoMetrics
+	labelValues []string
+	bridges     *bridgeTracker
+	restarts    *restartDetector
+	tls         *tlsReloader
+	ctx         context.Context
+
+	// onFatal is called when the error policy gives up on the broker
+	onFatal func(error)
+
+	// topicRules map messages on application topics to metrics
+	topicRules []*topicRule
+
+	// traffic accounts the messages on application topics, if enabled
+	traffic *trafficAccount
+
+	// topicGroups record the distributions of messages on application topics
+	topicGroups []*topicGroup
+
+	// retained is the last retained message inventory, if the census is enabled
+	retained atomic.Pointer[retainedInventory]
+
+	mu         sync.Mutex
+	mqttClient mqtt.Client
+	lastError  *connectError
+
+	// connecting is the token of the last connection attempt
+	connecting mqtt.Token
+
+	// wasConnected is set once the broker has been connected; only used by connectToBroker
+	wasConnected bool
+
+	// disconnected wakes maintainConnection when the connection is lost or closed for a reconnect
+	disconnected chan struct{}
+
+	// connectStart is when the current connection attempt started, in Unix nanoseconds
+	connectStart atomic.Int64
+
+	// subscribed is set while the $SYS/# subscription of the current connection is active
+	subscribed atomic.Bool
+
+	// lastMessage is when the last $SYS message was received, in Unix nanoseconds
+	lastMessage atomic.Int64
+}
+
+// connectError is the last error that prevented connecting to a broker
+type connectError struct {
+	Class   string    `json:"class"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	Fatal   bool      `json:"fatal"`
+}
+
+// brokerStatus is the state of a broker connection as reported by /health and /ready
+type brokerStatus struct {
+	Name        string        `json:"name"`
+	Connected   bool          `json:"connected"`
+	Subscribed  bool          `json:"subscribed"`
+	LastMessage *time.Time    `json:"last_message,omitempty"`
+	LastError   *connectError `json:"last_error,omitempty"`
+}
+
+// newBrokerConnection creates a connection manager for the given broker.
+// settings holds the options shared by all brokers.
+func newBrokerConnection(cfg *BrokerConfig, settings *MosquittoConfig, metrics *MosquittoMetrics) *brokerConnection {
+	bc := &brokerConnection{
+		config:       cfg,
+		settings:     settings,
+		backoff:      newBackoff(&settings.Reconnect),
+		disconnected: make(chan struct{}, 1),
+		metrics:      metrics,
+		labelValues:  cfg.LabelValues(metrics.LabelNames()),
+		bridges:      newBridgeTracker(metrics.DeleteSeries),
+		restarts:     newRestartDetector(),
+	}
+
+	if len(settings.TopicGroups) > 0 {
+		bc.topicGroups = newTopicGroups(settings.TopicGroups, bc.labelValues, metrics)
+	}
+
+	if settings.Traffic.Enabled {
+		bc.traffic = newTrafficAccount(settings.Traffic.Topics, settings.Traffic.PrefixDepth, settings.Traffic.MaxPrefixes)
+		metrics.AddTrafficAccount(bc.labelValues, bc.traffic)
+	}
+
+	return bc
+}
+
+// Start creates the MQTT client and connects to the broker in a goroutine
+func (bc *brokerConnection) Start(ctx context.Context) {
+	bc.ctx = ctx
+
+	slog.Info("Starting broker connection",
+		"broker", bc.config.Name,
+		"endpoint", bc.config.BrokerEndpoint,
+		"client_id", bc.config.ClientID,
+		"tls_enabled", bc.config.TLS.Enabled,
+	)
+
+	// Set initial connection status to disconnected
+	bc.metrics.InitBroker(bc.labelValues)
+
+	// The log file is read independently of the MQTT connection
+	if bc.config.LogFile != "" {
+		go newLogTailer(bc.config.LogFile, bc.processLogLine).Run(ctx)
+	}
+
+	if bc.settings.Expiry.Intervals > 0 {
+		go bc.expireSeries()
+	}
+
+	// The census and round-trip probe use their own connections
+	if bc.settings.Retained.Enabled {
+		go bc.runRetainedCensus()
+	}
+
+	if bc.settings.RoundTrip.Enabled {
+		prober := newRoundTripProber(bc, &bc.settings.RoundTrip)
+		bc.metrics.AddRoundTripProber(bc.labelValues, prober)
+		bc.metrics.SetRoundTripConnected(bc.labelValues, false)
+
+		go prober.Run(ctx)
+	}
+
+	// Connect to broker in a goroutine
+	go bc.maintainConnection()
+}
+
+// Stop disconnects from the broker
+func (bc *brokerConnection) Stop() {
+	client := bc.client()
+	if client == nil {
+		return
+	}
+
+	// Disconnect doesn't stop a connection attempt in progress, so let it
+	// finish first rather than leave it connected
+	bc.mu.Lock()
+	connecting := bc.connecting
+	bc.mu.Unlock()
+
+	if connecting != nil {
+		connecting.Wait()
+	}
+
+	connected := client.IsConnectionOpen()
+	bc.subscribed.Store(false)
+
+	client.Disconnect(250)
+
+	if connected {
+		bc.metrics.SetBrokerConnected(bc.labelValues, false)
+		slog.Info("Disconnected from MQTT broker", "broker", bc.config.Name)
+	}
+}
+
+// clientOptions builds the MQTT client options for the broker
+func (bc *brokerConnection) clientOptions() (*mqtt.ClientOptions, error) {
+	opts, err := bc.connectionOptions(bc.config.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Configure TLS if enabled
+	if bc.config.TLS.Enabled {
+		if err := bc.configureTLS(opts); err != nil {
+			return nil, &tlsSetupError{err: err}
+		}
+	}
+
+	// Set connection callbacks
+	opts.OnConnect = bc.onConnect
+	opts.OnConnectionLost = bc.onConnectionLost
+
+	// Application topics are subscribed without a callback of their own
+	opts.SetDefaultPublishHandler(bc.messageHandler)
+	opts.SetConnectionNotificationHandler(bc.onConnectionNotification)
+
+	return opts, nil
+}
+
+// connectionOptions builds the client options for connecting to the broker
+// with clientID, without TLS or callbacks
+func (bc *brokerConnection) connectionOptions(clientID string) (*mqtt.ClientOptions, error) {
+	endpoint, err := bc.config.EndpointURL()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.SetCleanSession(true)
+
+	// Reconnects are handled by maintainConnection, with the same backoff as the initial connection
+	opts.SetAutoReconnect(false)
+
+	if timeout := bc.settings.Reconnect.ConnectTimeout.Duration; timeout > 0 {
+		opts.SetConnectTimeout(timeout)
+	}
+	opts.AddBroker(endpoint.String())
+
+	// The v5 client speaks only MQTT v5; the v3 client negotiates 3.1.1 and 3.1 by default
+	if version := bc.config.ProtocolVersion; version == 3 || version == 4 {
+		opts.SetProtocolVersion(uint(version))
+	}
+
+	// Set client ID if provided
+	if clientID != "" {
+		opts.SetClientID(clientID)
+	}
+
+	// Set username and password if provided
+	if bc.config.Username != "" {
+		opts.SetUsername(bc.config.Username)
+
+		if !bc.config.Password.IsEmpty() {
+			opts.SetPassword(bc.config.Password.Value())
+		}
+	}
+
+	if isWebSocketEndpoint(endpoint) {
+		headers := make(http.Header)
+		for name, value := range bc.config.WebSocket.Headers {
+			headers.Set(name, value.Value())
+		}
+
+		if bc.config.WebSocket.Origin != "" {
+			headers.Set("Origin", bc.config.WebSocket.Origin)
+		}
+
+		opts.SetHTTPHeaders(headers)
+	}
+
+	// Unix sockets and configured proxies are dialed by the exporter;
+	// otherwise the MQTT client dials itself, using proxies from the environment
+	switch {
+	case endpoint.Scheme == "unix":
+		opts.SetCustomOpenConnectionFn(openUnixConnection)
+	case bc.config.Proxy.URL != "":
+		dialer, err := newProxyDialer(&bc.config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("configure proxy: %w", err)
+		}
+
+		opts.SetWebsocketOptions(dialer.WebsocketOptions())
+		opts.SetCustomOpenConnectionFn(dialer.OpenConnection)
+	}
+
+	return opts, nil
+}
+
+// maintainConnection connects to the broker, and again whenever the
+// connection is lost, until ctx is done
+func (bc *brokerConnection) maintainConnection() {
+	for {
+		bc.connectToBroker()
+
+		select {
+		case <-bc.ctx.Done():
+			return
+		case <-bc.disconnected:
+		}
+	}
+}
+
+// connectToBroker tries to connect to the MQTT broker until it succeeds,
+// ctx is done or the error policy gives up, backing off exponentially
+// between attempts. The MQTT client is created on the first attempt, so
+// that TLS files that can't be loaded yet are retried like other errors.
+func (bc *brokerConnection) connectToBroker() {
+	for {
+		client, err := bc.ensureClient()
+		if err == nil {
+			if client.IsConnectionOpen() {
+				return
+			}
+
+			token := client.Connect()
+
+			bc.mu.Lock()
+			bc.connecting = token
+			bc.mu.Unlock()
+
+			err = waitToken(bc.ctx, token)
+		}
+
+		if bc.ctx.Err() != nil {
+			slog.Info("Connection attempt cancelled", "broker", bc.config.Name)
+			return
+		}
+
+		if err == nil {
+			slog.Info("Successfully connected to MQTT broker", "broker", bc.config.Name)
+			bc.wasConnected = true
+			bc.backoff.Reset()
+			bc.metrics.SetConnectBackoff(bc.labelValues, 0, 0)
+
+			return
+		}
+
+		class := classifyError(err)
+		fatal := bc.settings.ErrorPolicy.IsFatal(class)
+		bc.setLastError(err, class, fatal)
+
+		// Fatal errors only stop the exporter before the broker was ever
+		// connected; later on they may be fixed on the broker side
+		if fatal && !bc.wasConnected && bc.onFatal != nil {
+			bc.onFatal(fmt.Errorf("connect to broker %s: %s error: %w", bc.config.Name, class, err))
+			return
+		}
+
+		delay := bc.backoff.Next()
+		bc.metrics.SetConnectBackoff(bc.labelValues, delay, bc.backoff.Failures())
+
+		slog.Error("Failed to connect to broker",
+			"broker", bc.config.Name,
+			"error", err,
+			"class", class,
+			"consecutive_failures", bc.backoff.Failures(),
+			"retry_in", delay,
+		)
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-bc.ctx.Done():
+			timer.Stop()
+			slog.Info("Connection attempt cancelled", "broker", bc.config.Name)
+
+			return
+		case <-timer.C:
+		}
+
+		bc.metrics.SetConnectBackoff(bc.labelValues, 0, bc.backoff.Failures())
+	}
+}
+
+// client returns the MQTT client, or nil if it hasn't been created yet
+func (bc *brokerConnection) client() mqtt.Client {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	return bc.mqttClient
+}
+
+// ensureClient returns the MQTT client, creating it if needed
+func (bc *brokerConnection) ensureClient() (mqtt.Client, error) {
+	if client := bc.client(); client != nil {
+		return client, nil
+	}
+
+	opts, err := bc.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	client := bc.newClient(opts)
+
+	bc.mu.Lock()
+	bc.mqttClient = client
+	bc.mu.Unlock()
+
+	if bc.tls != nil {
+		go bc.watchTLS()
+	}
+
+	return client, nil
+}
+
+// newClient creates the MQTT client for the broker's protocol version
+func (bc *brokerConnection) newClient(opts *mqtt.ClientOptions) mqtt.Client {
+	if bc.config.ProtocolVersion != 5 {
+		return mqtt.NewClient(opts)
+	}
+
+	return newV5Client(opts, v5Settings{
+		sessionExpiry:  uint32(bc.config.SessionExpiry.Duration / time.Second), //nolint:gosec // validated to fit
+		userProperties: bc.userProperties(),
+		onConnack:      bc.onConnack,
+		onDisconnect:   bc.onServerDisconnect,
+	})
+}
+
+// userProperties returns the configured MQTT v5 user properties, in a stable order
+func (bc *brokerConnection) userProperties() paho.UserProperties {
+	keys := make([]string, 0, len(bc.config.UserProperties))
+	for key := range bc.config.UserProperties {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var properties paho.UserProperties
+	for _, key := range keys {
+		properties.Add(key, bc.config.UserProperties[key])
+	}
+
+	return properties
+}
+
+// newAuxiliaryClient creates a client for a short-lived connection to the
+// broker besides the $SYS subscription, such as the retained message census.
+// It connects with the client ID followed by "-" and suffix, if one is
+// configured, without a persistent session. It uses the TLS material of the
+// main connection but doesn't report its handshakes, so it doesn't count
+// towards the broker's connection or TLS metrics.
+func (bc *brokerConnection) newAuxiliaryClient(suffix string, timeout time.Duration) (mqtt.Client, error) {
+	clientID := bc.config.ClientID
+	if clientID != "" {
+		clientID += "-" + suffix
+	}
+
+	opts, err := bc.connectionOptions(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if bc.config.TLS.Enabled {
+		tlsConfig, err := bc.auxiliaryTLSConfig()
+		if err != nil {
+			return nil, &tlsSetupError{err: err}
+		}
+
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	opts.OnConnectionLost = nil
+	opts.SetConnectTimeout(timeout)
+
+	if bc.config.ProtocolVersion != 5 {
+		return mqtt.NewClient(opts), nil
+	}
+
+	return newV5Client(opts, v5Settings{userProperties: bc.userProperties()}), nil
+}
+
+// auxiliaryTLSConfig returns a TLS configuration for auxiliary clients that
+// doesn't report their handshakes. It uses the main connection's material,
+// so reloads apply to them too, or loads it if the main client hasn't yet.
+func (bc *brokerConnection) auxiliaryTLSConfig() (*tls.Config, error) {
+	// bc.tls is set before the main client, and never changes afterwards
+	if bc.client() != nil && bc.tls != nil {
+		return bc.tls.UnobservedTLSConfig(), nil
+	}
+
+	reloader, err := bc.newTLSReloader()
+	if err != nil {
+		return nil, err
+	}
+
+	return reloader.UnobservedTLSConfig(), nil
+}
+
+// setLastError records the error of a failed connection attempt
+func (bc *brokerConnection) setLastError(err error, class string, fatal bool) {
+	now := time.Now()
+
+	bc.mu.Lock()
+	bc.lastError = &connectError{
+		Class:   class,
+		Message: err.Error(),
+		Time:    now,
+		Fatal:   fatal,
+	}
+	bc.mu.Unlock()
+
+	bc.metrics.SetLastConnectError(bc.labelValues, class, now)
+}
+
+// Status returns the current state of the connection
+func (bc *brokerConnection) Status() brokerStatus {
+	status := brokerStatus{Name: bc.config.Name}
+
+	client := bc.client()
+	status.Connected = client != nil && client.IsConnectionOpen()
+	status.Subscribed = status.Connected && bc.subscribed.Load()
+
+	if last := bc.lastMessage.Load(); last != 0 {
+		t := time.Unix(0, last)
+		status.LastMessage = &t
+	}
+
+	bc.mu.Lock()
+	status.LastError = bc.lastError
+	bc.mu.Unlock()
+
+	return status
+}
+
+// signalDisconnected wakes maintainConnection to reconnect
+func (bc *brokerConnection) signalDisconnected() {
+	select {
+	case bc.disconnected <- struct{}{}:
+	default:
+	}
+}
+
+// configureTLS sets up TLS configuration
+func (bc *brokerConnection) configureTLS(opts *mqtt.ClientOptions) error {
+	reloader, err := bc.newTLSReloader()
+	if err != nil {
+		return err
+	}
+
+	reloader.onVerify = func(chain []*x509.Certificate, err error) {
+		bc.metrics.SetTLSServerCertificate(bc.labelValues, chain, err)
+	}
+	reloader.onConnection = func(state tls.ConnectionState) {
+		bc.metrics.SetTLSConnection(bc.labelValues, state)
+	}
+
+	bc.tls = reloader
+
+	if reloader.Material().certificate == nil {
+		slog.Info("TLS enabled without client certificate; using server-auth TLS only", "broker", bc.config.Name)
+	}
+
+	opts.SetTLSConfig(reloader.TLSConfig())
+	bc.metrics.SetTLSReloadResult(bc.labelValues, true, reloader.Material().NotAfter())
+
+	if bc.config.TLS.InsecureSkipVerify {
+		slog.Warn("TLS certificate verification is disabled; this should only be used for testing", "broker", bc.config.Name)
+	}
+
+	// Warn if endpoint doesn't use TLS scheme; it was parsed by newTLSReloader
+	if endpoint, _ := parseEndpoint(bc.config.BrokerEndpoint); !isTLSEndpoint(endpoint) {
+		slog.Warn("TLS configured but endpoint doesn't use ssl://, tls:// or wss:// scheme", "broker", bc.config.Name, "endpoint", bc.config.BrokerEndpoint)
+	}
+
+	return nil
+}
+
+// newTLSReloader loads the broker's TLS material
+func (bc *brokerConnection) newTLSReloader() (*tlsReloader, error) {
+	// Verify against the endpoint host unless tls.server_name overrides it
+	endpoint, err := parseEndpoint(bc.config.BrokerEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTLSReloader(&bc.config.TLS, endpoint.Hostname())
+}
+
+// watchTLS reloads the TLS material when its files change and reconnects so
+// that new trust material is used for the connection
+func (bc *brokerConnection) watchTLS() {
+	ticker := time.NewTicker(tlsReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-bc.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := bc.tls.Reload()
+		if err != nil {
+			slog.Error("Failed to reload TLS material; keeping the previous one", "broker", bc.config.Name, "error", err)
+			bc.metrics.SetTLSReloadResult(bc.labelValues, false, bc.tls.Material().NotAfter())
+
+			continue
+		}
+
+		if !changed {
+			continue
+		}
+
+		slog.Info("TLS material changed; reconnecting", "broker", bc.config.Name)
+		bc.metrics.SetTLSReloadResult(bc.labelValues, true, bc.tls.Material().NotAfter())
+		bc.reconnect()
+	}
+}
+
+// reconnect closes an open connection and connects again. If there is no
+// open connection, the pending connection attempt picks up any new settings.
+func (bc *brokerConnection) reconnect() {
+	client := bc.client()
+	if !client.IsConnectionOpen() {
+		return
+	}
+
+	client.Disconnect(250)
+	bc.subscribed.Store(false)
+	bc.metrics.SetBrokerConnected(bc.labelValues, false)
+
+	bc.signalDisconnected()
+}
+
+// expireSeries periodically removes series that haven't been updated for the
+// configured number of sys_intervals
+func (bc *brokerConnection) expireSeries() {
+	interval := bc.settings.Expiry.SysInterval.Duration
+	maxAge := time.Duration(bc.settings.Expiry.Intervals) * interval
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-bc.ctx.Done():
+			return
+		case now := <-ticker.C:
+			bc.metrics.ExpireSeries(bc.labelValues, now.Add(-maxAge))
+		}
+	}
+}
+
+// onConnect is called when successfully connected to the broker
+func (bc *brokerConnection) onConnect(client mqtt.Client) {
+	// An attempt that finishes while stopping is closed by Stop
+	if bc.ctx.Err() != nil {
+		return
+	}
+
+	slog.Info("Connected to MQTT broker", "broker", bc.config.Name, "endpoint", bc.config.BrokerEndpoint)
+
+	// Update connection status metric
+	bc.metrics.SetBrokerConnected(bc.labelValues, true)
+
+	// Bridges must be re-announced by the retained $SYS tree we're about to receive
+	bc.bridges.StartCycle()
+
+	// Subscribe to $SYS/# topic
+	bc.subscribed.Store(false)
+
+	token := client.Subscribe("$SYS/#", 0, bc.messageHandler)
+	if !token.WaitTimeout(10 * time.Second) {
+		slog.Error("Timeout subscribing to topic $SYS/#", "broker", bc.config.Name)
+		bc.metrics.IncSubscribeFailure(bc.labelValues)
+
+		return
+	}
+
+	if err := token.Error(); err != nil {
+		slog.Error("Failed to subscribe to topic $SYS/#", "broker", bc.config.Name, "error", err)
+		bc.metrics.IncSubscribeFailure(bc.labelValues)
+
+		return
+	}
+
+	bc.subscribed.Store(true)
+	slog.Info("Successfully subscribed to $SYS/# topic", "broker", bc.config.Name)
+
+	bc.subscribeApplicationTopics(client)
+}
+
+// subscribeApplicationTopics subscribes to the application topics of the
+// topic metric rules, traffic accounting and topic groups. Failures are
+// logged, as $SYS metrics work without them.
+func (bc *brokerConnection) subscribeApplicationTopics(client mqtt.Client) {
+	subscriptions := make(map[string]byte)
+	for _, rule := range bc.topicRules {
+		subscriptions[rule.filter] = 0
+	}
+
+	if bc.traffic != nil {
+		for _, filter := range bc.settings.Traffic.Topics {
+			subscriptions[filter] = 0
+		}
+	}
+
+	for _, group := range bc.topicGroups {
+		group.Reset()
+
+		for _, filter := range group.filters {
+			subscriptions[filter] = topicGroupQoS
+		}
+	}
+
+	if len(subscriptions) == 0 {
+		return
+	}
+
+	// Overlapping subscriptions may deliver a message once for each of them
+	filters := minimalSubscriptions(subscriptions)
+
+	for _, group := range bc.topicGroups {
+		group.SetSubscriptions(filters)
+	}
+
+	// A nil callback delivers messages to the default publish handler
+	token := client.SubscribeMultiple(filters, nil)
+	if !token.WaitTimeout(10 * time.Second) {
+		slog.Error("Timeout subscribing to application topics", "broker", bc.config.Name)
+		return
+	}
+
+	if err := token.Error(); err != nil {
+		slog.Error("Failed to subscribe to application topics", "broker", bc.config.Name, "error", err)
+		return
+	}
+
+	slog.Info("Successfully subscribed to application topics", "broker", bc.config.Name, "topics", len(filters))
+}
+
+// onConnectionLost is called when connection to broker is lost
+func (bc *brokerConnection) onConnectionLost(client mqtt.Client, err error) {
+	slog.Error("Connection to MQTT broker lost", "error", err, "broker", bc.config.Name, "endpoint", bc.config.BrokerEndpoint)
+
+	// Update connection status metric
+	bc.subscribed.Store(false)
+	bc.metrics.SetBrokerConnected(bc.labelValues, false)
+
+	// Values from a broker we can't see are stale
+	if bc.settings.Expiry.DropOnDisconnect {
+		bc.metrics.DropBrokerSeries(bc.labelValues)
+	}
+
+	bc.signalDisconnected()
+}
+
+// onConnack records the reason code of an MQTT v5 CONNACK and logs the
+// session the broker granted
+func (bc *brokerConnection) onConnack(connack *paho.Connack) {
+	reason := connackReason(connack.ReasonCode)
+	bc.metrics.IncConnackReason(bc.labelValues, connack.ReasonCode, reason)
+
+	if connack.ReasonCode >= 0x80 {
+		return
+	}
+
+	// The broker may override the requested session expiry
+	sessionExpiry := time.Duration(bc.config.SessionExpiry.Duration/time.Second) * time.Second
+	attrs := []any{
+		"broker", bc.config.Name,
+		"reason_code", fmt.Sprintf("0x%02X", connack.ReasonCode),
+		"reason", reason,
+		"session_present", connack.SessionPresent,
+	}
+
+	if props := connack.Properties; props != nil {
+		if props.SessionExpiryInterval != nil {
+			sessionExpiry = time.Duration(*props.SessionExpiryInterval) * time.Second
+		}
+
+		if props.AssignedClientID != "" {
+			attrs = append(attrs, "assigned_client_id", props.AssignedClientID)
+		}
+
+		if props.ServerKeepAlive != nil {
+			attrs = append(attrs, "server_keep_alive", time.Duration(*props.ServerKeepAlive)*time.Second)
+		}
+
+		if props.ReasonString != "" {
+			attrs = append(attrs, "reason_string", props.ReasonString)
+		}
+
+		if len(props.User) > 0 {
+			attrs = append(attrs, "user_properties", formatUserProperties(props.User))
+		}
+	}
+
+	bc.metrics.SetSessionExpiry(bc.labelValues, sessionExpiry)
+	slog.Info("MQTT v5 session established", append(attrs, "session_expiry", sessionExpiry)...)
+}
+
+// onServerDisconnect records the reason code of an MQTT v5 DISCONNECT sent by
+// the broker. The connection loss itself is handled by onConnectionLost.
+func (bc *brokerConnection) onServerDisconnect(disconnect *paho.Disconnect) {
+	reason := disconnectReason(disconnect.ReasonCode)
+	bc.metrics.IncDisconnectReason(bc.labelValues, disconnect.ReasonCode, reason)
+
+	if props := disconnect.Properties; props != nil && (props.ServerReference != "" || len(props.User) > 0) {
+		slog.Warn("Broker closed the connection",
+			"broker", bc.config.Name,
+			"reason_code", fmt.Sprintf("0x%02X", disconnect.ReasonCode),
+			"reason", reason,
+			"server_reference", props.ServerReference,
+			"user_properties", formatUserProperties(props.User),
+		)
+	}
+}
+
+// onConnectionNotification instruments connection attempts, including the
+// MQTT client library's automatic reconnects
+func (bc *brokerConnection) onConnectionNotification(_ mqtt.Client, notification mqtt.ConnectionNotification) {
+	switch n := notification.(type) {
+	case mqtt.ConnectionNotificationConnecting:
+		bc.metrics.IncConnectAttempt(bc.labelValues)
+		bc.connectStart.Store(time.Now().UnixNano())
+	case mqtt.ConnectionNotificationFailed:
+		bc.metrics.IncConnectFailure(bc.labelValues, classifyError(n.Reason))
+	case mqtt.ConnectionNotificationConnected:
+		if start := bc.connectStart.Swap(0); start != 0 {
+			bc.metrics.ObserveConnectDuration(bc.labelValues, time.Since(time.Unix(0, start)))
+		}
+	}
+}
+
+// messageHandler processes incoming MQTT messages, dispatching $SYS and
+// application topics to their own pipelines
+func (bc *brokerConnection) messageHandler(_ mqtt.Client, msg mqtt.Message) {
+	if strings.HasPrefix(msg.Topic(), "$SYS/") {
+		bc.processSysMessage(msg)
+		return
+	}
+
+	bc.processApplicationMessage(msg)
+}
+
+// processSysMessage processes a message on a $SYS topic
+func (bc *brokerConnection) processSysMessage(msg mqtt.Message) {
+	start := time.Now()
+	defer func() { bc.metrics.ObserveHandlerDuration(bc.labelValues, time.Since(start)) }()
+
+	topic := msg.Topic()
+	payload := string(msg.Payload())
+	subtree := sysSubtree(topic)
+
+	// Update last message timestamp
+	bc.lastMessage.Store(start.UnixNano())
+	bc.metrics.UpdateLastMessageTimestamp(bc.labelValues)
+	bc.metrics.IncMessageReceived(bc.labelValues, subtree)
+
+	// Handle broker version as an info metric with a version label
+	if topic == "$SYS/broker/version" {
+		bc.metrics.SetBrokerVersion(bc.labelValues, payload)
+		return
+	}
+
+	// Uptime is published every $SYS interval and marks the broker's publish cycle
+	if topic == uptimeTopic {
+		bc.bridges.Uptime()
+		bc.processUptime(payload)
+	}
+
+	if restartCounterTopics[topic] && bc.restarts.Counter(topic, parseValue(payload)) {
+		slog.Info("Broker restart detected from decreasing counter", "broker", bc.config.Name, "topic", topic)
+		bc.metrics.RecordBrokerRestart(bc.labelValues)
+	}
+
+	// Check if topic should be ignored
+	if bc.metrics.ShouldIgnoreTopic(topic) {
+		bc.metrics.IncIgnoredTopic(bc.labelValues)
+		return
+	}
+
+	// Broker log lines (log_dest topic) are parsed rather than treated as values
+	if severity, ok := logSeverityForTopic(topic); ok {
+		bc.metrics.IncLogMessage(bc.labelValues, severity)
+
+		// The log file is the only source of client activity if it's read
+		if bc.config.LogFile == "" {
+			bc.metrics.RecordLogEvent(bc.labelValues, parseLogLine(payload))
+		}
+
+		return
+	}
+
+	// Bridge connections are exported in shared families with a bridge label
+	if metric, bridge, ok := bridgeMetricForTopic(topic); ok {
+		bc.processBridgeMetric(topic, bridge, metric, payload)
+		return
+	}
+
+	value, ok := parseNumber(payload)
+	if !ok {
+		bc.metrics.IncUnparseablePayload(bc.labelValues, subtree)
+	}
+
+	// Map the topic to a metric under the configured naming mode
+	metric := bc.metrics.MetricForTopic(topic)
+	bc.metrics.SetTopicValue(bc.labelValues, topic, metric, value)
+}
+
+// processApplicationMessage accounts a message on an application topic,
+// records it in its topic groups and sets the metrics of the topic metric
+// rules matching it
+func (bc *brokerConnection) processApplicationMessage(msg mqtt.Message) {
+	topic := msg.Topic()
+
+	// Retained messages are replayed on every subscribe rather than produced
+	if bc.traffic != nil && !msg.Retained() {
+		bc.traffic.Record(topic, len(msg.Payload()))
+	}
+
+	if len(bc.topicGroups) > 0 {
+		now := time.Now()
+
+		for _, group := range bc.topicGroups {
+			if group.Matches(topic) {
+				group.Record(msg, now)
+			}
+		}
+	}
+
+	var payload *jsonPayload
+
+	for _, rule := range bc.topicRules {
+		metric, ok := rule.Match(topic)
+		if !ok {
+			continue
+		}
+
+		// The payload is decoded once for all rules matching the message
+		if payload == nil {
+			payload = &jsonPayload{raw: msg.Payload()}
+		}
+
+		value, err := rule.Value(payload)
+		if err != nil {
+			slog.Debug("No value for topic metric", "broker", bc.config.Name, "topic", topic, "metric", metric.Name, "error", err)
+			bc.metrics.IncTopicMetricError(bc.labelValues, metric.Name)
+
+			continue
+		}
+
+		bc.metrics.SetTopicRuleValue(bc.labelValues, metric, value)
+	}
+}
+
+// processUptime detects restarts from the broker's uptime and tracks its start time
+func (bc *brokerConnection) processUptime(payload string) {
+	restarted, startTime, changed := bc.restarts.Uptime(parseValue(payload), time.Now())
+	if restarted {
+		slog.Info("Broker restart detected from uptime", "broker", bc.config.Name)
+		bc.metrics.RecordBrokerRestart(bc.labelValues)
+	}
+
+	if changed {
+		bc.metrics.SetBrokerStartTime(bc.labelValues, startTime)
+	}
+}
+
+// processLogLine counts the client activity reported by a line of the broker's log file
+func (bc *brokerConnection) processLogLine(line string) {
+	bc.metrics.RecordLogEvent(bc.labelValues, parseLogLine(line))
+}
+
+// processBridgeMetric processes a value from a bridge's $SYS subtree
+func (bc *brokerConnection) processBridgeMetric(topic, bridge string, metric topicMetric, payload string) {
+	// Clearing the retained state removes the bridge
+	if payload == "" {
+		bc.bridges.Remove(bridge)
+		return
+	}
+
+	value, ok := parseNumber(payload)
+	if !ok {
+		bc.metrics.IncUnparseablePayload(bc.labelValues, sysSubtree(topic))
+	}
+
+	bc.metrics.SetTopicValue(bc.labelValues, topic, metric, value)
+	bc.bridges.Seen(bridge, metric.Name, prometheus.Labels{"broker": bc.labelValues[0], "bridge": bridge})
+
+	// Legacy naming keeps exporting the flattened per-bridge metric as well
+	if bc.metrics.Naming() == NamingLegacy {
+		legacy := bc.metrics.MetricForTopic(topic)
+
+		bc.metrics.SetTopicValue(bc.labelValues, topic, legacy, value)
+		bc.bridges.Seen(bridge, legacy.Name, prometheus.Labels{"broker": bc.labelValues[0]})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testMessage is an MQTT message received on topic
+type testMessage struct {
+	topic    string
+	payload  string
+	qos      byte
+	retained bool
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return m.qos }
+func (m *testMessage) Retained() bool    { return m.retained }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 0 }
+func (m *testMessage) Payload() []byte   { return []byte(m.payload) }
+func (m *testMessage) Ack()              {}
+
+// newTestBroker returns a connection to broker b that isn't started, with
+// its metrics in registry
+func newTestBroker(registry *prometheus.Registry, naming string, settings *MosquittoConfig) *brokerConnection {
+	return newBrokerConnection(&BrokerConfig{Name: "b"}, settings, NewProbeMetrics(registry, naming))
+}
+
+func TestStructuredRetainedMessages(t *testing.T) {
+	for _, census := range []bool{false, true} {
+		registry := prometheus.NewRegistry()
+		bc := newTestBroker(registry, NamingStructured, &MosquittoConfig{})
+
+		if census {
+			bc.metrics.EnableRetainedCensus()
+		}
+
+		bc.processSysMessage(&testMessage{topic: "$SYS/broker/retained messages/count", payload: "42"})
+
+		want := `
+# HELP mosquitto_retained_messages The total number of retained messages active on the broker.
+# TYPE mosquitto_retained_messages gauge
+mosquitto_retained_messages{broker="b"} 42
+`
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "mosquitto_retained_messages"); err != nil {
+			t.Errorf("census enabled %t: %v", census, err)
+		}
+	}
+}
+
+func TestTrafficSkipsRetainedMessages(t *testing.T) {
+	settings := &MosquittoConfig{Traffic: TrafficConfig{Enabled: true, Topics: []string{"#"}, PrefixDepth: 1, MaxPrefixes: 10}}
+	bc := newTestBroker(prometheus.NewRegistry(), NamingLegacy, settings)
+
+	// The retained set is replayed on every subscribe
+	for range 2 {
+		bc.processApplicationMessage(&testMessage{topic: "a/x", payload: "retained", retained: true})
+	}
+
+	bc.processApplicationMessage(&testMessage{topic: "a/x", payload: "live"})
+
+	counter := bc.traffic.prefixes["a"]
+	if counter == nil {
+		t.Fatal("prefix a not accounted")
+	}
+
+	if messages, bytes := counter.messages.Load(), counter.bytes.Load(); messages != 1 || bytes != 4 {
+		t.Errorf("prefix a has %d messages and %d bytes, want 1 and 4", messages, bytes)
+	}
+}
+
+func TestLogSourceCountedOnce(t *testing.T) {
+	for _, logFile := range []string{"", "/var/log/mosquitto/mosquitto.log"} {
+		registry := prometheus.NewRegistry()
+		bc := newTestBroker(registry, NamingLegacy, &MosquittoConfig{})
+		bc.config.LogFile = logFile
+
+		line := "1700000000: Client sensor-1 disconnected."
+		bc.processSysMessage(&testMessage{topic: "$SYS/broker/log/N", payload: line})
+
+		// The tailer calls this for every line of the file
+		if logFile != "" {
+			bc.processLogLine(line)
+		}
+
+		if got := testutil.ToFloat64(bc.metrics.logDisconnections.WithLabelValues("b", disconnectReasonClient)); got != 1 {
+			t.Errorf("log file %q: %g disconnections counted, want 1", logFile, got)
+		}
+
+		if got := testutil.ToFloat64(bc.metrics.logMessages.WithLabelValues("b", "notice")); got != 1 {
+			t.Errorf("log file %q: %g log messages counted, want 1", logFile, got)
+		}
+	}
+}
@@ -2,55 +2,82 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"fmt"
 	"log/slog"
+	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/d0ugal/promexporter/app"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-// MosquittoCollector implements the app.Collector interface for MQTT metric collection
+// MosquittoCollector implements the app.Collector interface for MQTT metric collection.
+// It owns one brokerConnection per configured broker.
 type MosquittoCollector struct {
-	config     *MosquittoExporterConfig
-	metrics    *MosquittoMetrics
-	mqttClient mqtt.Client
-	app        *app.App
-	ctx        context.Context
-	cancel     context.CancelFunc
+	config  *MosquittoExporterConfig
+	metrics *MosquittoMetrics
+	app     *app.App
+	brokers []*brokerConnection
+	ctx     context.Context
+	cancel  context.CancelFunc
+	exit    sync.Once
+
+	mu  sync.Mutex
+	err error
+
+	// signals catches SIGTERM, which is handled by the app
+	signals chan os.Signal
 }
 
 // NewMosquittoCollector creates a new Mosquitto collector
 func NewMosquittoCollector(cfg *MosquittoExporterConfig, metrics *MosquittoMetrics, application *app.App) *MosquittoCollector {
-	return &MosquittoCollector{
+	brokers := make([]*brokerConnection, 0, len(cfg.Mosquitto.Brokers))
+	for i := range cfg.Mosquitto.Brokers {
+		brokers = append(brokers, newBrokerConnection(&cfg.Mosquitto.Brokers[i], &cfg.Mosquitto, metrics))
+	}
+
+	// validateConfig already rejected invalid rules
+	rules, err := newTopicRules(cfg.Mosquitto.TopicMetrics, metrics.LabelNames())
+	if err != nil {
+		slog.Error("Ignoring invalid topic metrics", "error", err)
+	}
+
+	mc := &MosquittoCollector{
 		config:  cfg,
 		metrics: metrics,
 		app:     application,
+		brokers: brokers,
+		signals: make(chan os.Signal, 1),
 	}
+
+	for _, broker := range brokers {
+		broker.onFatal = mc.fatal
+		broker.topicRules = rules
+	}
+
+	return mc
 }
 
-// Start implements the Collector interface - starts MQTT connection and subscription
+// Start implements the Collector interface - starts one MQTT connection per broker
 func (mc *MosquittoCollector) Start(ctx context.Context) {
 	mc.ctx, mc.cancel = context.WithCancel(ctx)
 
-	slog.Info("Starting Mosquitto collector",
-		"broker", mc.config.Mosquitto.BrokerEndpoint,
-		"client_id", mc.config.Mosquitto.ClientID,
-		"tls_enabled", mc.config.Mosquitto.TLS.Enabled,
-	)
+	// Until the app handles signals, SIGTERM from fatal must not kill the
+	// process without shutting down
+	signal.Notify(mc.signals, syscall.SIGTERM)
 
-	// Set initial connection status to disconnected
-	mc.metrics.SetBrokerConnected(false)
+	slog.Info("Starting Mosquitto collector", "brokers", len(mc.brokers))
 
-	// Connect to broker in a goroutine
-	go mc.connectToBroker()
+	for _, broker := range mc.brokers {
+		broker.Start(mc.ctx)
+	}
 }
 
-// Stop implements the Collector interface - stops MQTT connection
+// Stop implements the Collector interface - stops all MQTT connections
 func (mc *MosquittoCollector) Stop() {
 	slog.Info("Stopping Mosquitto collector")
 
@@ -58,183 +85,81 @@ func (mc *MosquittoCollector) Stop() {
 		mc.cancel()
 	}
 
-	if mc.mqttClient != nil && mc.mqttClient.IsConnected() {
-		mc.mqttClient.Disconnect(250)
-		mc.metrics.SetBrokerConnected(false)
-		slog.Info("Disconnected from MQTT broker")
+	signal.Stop(mc.signals)
+
+	for _, broker := range mc.brokers {
+		broker.Stop()
 	}
 }
 
-// connectToBroker establishes connection to the MQTT broker with retry logic
-func (mc *MosquittoCollector) connectToBroker() {
-	opts := mqtt.NewClientOptions()
-	opts.SetCleanSession(true)
-	opts.AddBroker(mc.config.Mosquitto.BrokerEndpoint)
-
-	// Set client ID if provided
-	if mc.config.Mosquitto.ClientID != "" {
-		opts.SetClientID(mc.config.Mosquitto.ClientID)
-	}
+// fatal shuts the exporter down after the error policy gave up on a broker.
+// The app only shuts down on a signal, which stops the collectors, flushes
+// traces and profiles and closes the servers; main then exits with Err.
+func (mc *MosquittoCollector) fatal(err error) {
+	mc.exit.Do(func() {
+		slog.Error("Fatal error; shutting down", "error", err)
 
-	// Set username and password if provided
-	if mc.config.Mosquitto.Username != "" {
-		opts.SetUsername(mc.config.Mosquitto.Username)
+		mc.mu.Lock()
+		mc.err = err
+		mc.mu.Unlock()
 
-		if !mc.config.Mosquitto.Password.IsEmpty() {
-			opts.SetPassword(mc.config.Mosquitto.Password.Value())
-		}
-	}
+		go mc.shutdown()
+	})
+}
 
-	// Configure TLS if enabled
-	if mc.config.Mosquitto.TLS.Enabled {
-		if err := mc.configureTLS(opts); err != nil {
-			slog.Error("Failed to configure TLS", "error", err)
-			return
-		}
+// shutdown signals the process until the app stops the collector. A signal
+// sent before the app handles them is only caught by the collector's own
+// handler, see Start.
+func (mc *MosquittoCollector) shutdown() {
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		slog.Error("Failed to shut down; exiting", "error", err)
+		os.Exit(1)
 	}
 
-	// Set connection callbacks
-	opts.OnConnect = mc.onConnect
-	opts.OnConnectionLost = mc.onConnectionLost
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-	mc.mqttClient = mqtt.NewClient(opts)
-
-	// Try to connect with retry logic
 	for {
+		if err := process.Signal(syscall.SIGTERM); err != nil {
+			slog.Error("Failed to shut down; exiting", "error", err)
+			os.Exit(1)
+		}
+
 		select {
 		case <-mc.ctx.Done():
-			slog.Info("Connection attempt cancelled")
 			return
-		default:
-			token := mc.mqttClient.Connect()
-			if token.WaitTimeout(5 * time.Second) {
-				if token.Error() == nil {
-					slog.Info("Successfully connected to MQTT broker")
-					return
-				}
-
-				slog.Error("Failed to connect to broker", "error", token.Error())
-			} else {
-				slog.Warn("Timeout connecting to broker", "endpoint", mc.config.Mosquitto.BrokerEndpoint)
-			}
-
-			time.Sleep(5 * time.Second)
+		case <-ticker.C:
 		}
 	}
 }
 
-// configureTLS sets up TLS configuration
-func (mc *MosquittoCollector) configureTLS(opts *mqtt.ClientOptions) error {
-	certFile := mc.config.Mosquitto.TLS.CertFile
-	keyFile := mc.config.Mosquitto.TLS.KeyFile
-
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: mc.config.Mosquitto.TLS.InsecureSkipVerify, //nolint:gosec // opt-in via insecure_skip_verify config; defaults to false
-		ClientAuth:         tls.NoClientCert,
-	}
-
-	switch {
-	case certFile == "" && keyFile == "":
-		slog.Info("TLS enabled without client certificate; using server-auth TLS only")
-	case certFile == "" || keyFile == "":
-		return fmt.Errorf("both mosquitto.tls.cert_file and mosquitto.tls.key_file must be set together")
-	default:
-		keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
-			return fmt.Errorf("load client TLS key pair: %w", err)
-		}
-
-		tlsConfig.Certificates = []tls.Certificate{keyPair}
-	}
-
-	opts.SetTLSConfig(tlsConfig)
-
-	if mc.config.Mosquitto.TLS.InsecureSkipVerify {
-		slog.Warn("TLS certificate verification is disabled; this should only be used for testing")
-	}
+// Err returns the fatal error the exporter was shut down for, if any
+func (mc *MosquittoCollector) Err() error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
 
-	// Warn if endpoint doesn't use TLS scheme
-	endpoint := mc.config.Mosquitto.BrokerEndpoint
-	if !strings.HasPrefix(endpoint, "ssl://") && !strings.HasPrefix(endpoint, "tls://") {
-		slog.Warn("TLS configured but endpoint doesn't use ssl:// or tls:// scheme", "endpoint", endpoint)
-	}
-
-	return nil
+	return mc.err
 }
 
-// onConnect is called when successfully connected to the broker
-func (mc *MosquittoCollector) onConnect(client mqtt.Client) {
-	slog.Info("Connected to MQTT broker", "broker", mc.config.Mosquitto.BrokerEndpoint)
-
-	// Update connection status metric
-	mc.metrics.SetBrokerConnected(true)
-
-	// Subscribe to $SYS/# topic
-	token := client.Subscribe("$SYS/#", 0, mc.messageHandler)
-	if !token.WaitTimeout(10 * time.Second) {
-		slog.Error("Timeout subscribing to topic $SYS/#")
-		return
+// Statuses returns the connection state of every broker
+func (mc *MosquittoCollector) Statuses() []brokerStatus {
+	statuses := make([]brokerStatus, 0, len(mc.brokers))
+	for _, broker := range mc.brokers {
+		statuses = append(statuses, broker.Status())
 	}
 
-	if err := token.Error(); err != nil {
-		slog.Error("Failed to subscribe to topic $SYS/#", "error", err)
-		return
-	}
-
-	slog.Info("Successfully subscribed to $SYS/# topic")
-}
-
-// onConnectionLost is called when connection to broker is lost
-func (mc *MosquittoCollector) onConnectionLost(client mqtt.Client, err error) {
-	slog.Error("Connection to MQTT broker lost", "error", err, "broker", mc.config.Mosquitto.BrokerEndpoint)
-
-	// Update connection status metric
-	mc.metrics.SetBrokerConnected(false)
-
-	// Reconnection will be handled automatically by the MQTT client library
-	// or by our retry logic if needed
+	return statuses
 }
 
-// messageHandler processes incoming MQTT messages
-func (mc *MosquittoCollector) messageHandler(client mqtt.Client, msg mqtt.Message) {
-	topic := msg.Topic()
-	payload := string(msg.Payload())
-
-	// Update last message timestamp
-	mc.metrics.UpdateLastMessageTimestamp()
-
-	// Handle broker version as an info metric with a version label
-	if topic == "$SYS/broker/version" {
-		mc.metrics.SetBrokerVersion(payload)
-		return
-	}
-
-	// Check if topic should be ignored
-	if mc.metrics.ShouldIgnoreTopic(topic) {
-		return
+// RetainedInventories returns the last retained message census of every broker
+func (mc *MosquittoCollector) RetainedInventories() []retainedInventory {
+	inventories := make([]retainedInventory, 0, len(mc.brokers))
+	for _, broker := range mc.brokers {
+		inventories = append(inventories, broker.RetainedInventory())
 	}
 
-	// Parse the metric name from topic
-	metricName := parseTopic(topic)
-
-	// Determine if this is a counter or gauge and process accordingly
-	if mc.metrics.IsCounterTopic(topic) {
-		mc.processCounterMetric(metricName, payload)
-	} else {
-		mc.processGaugeMetric(metricName, payload)
-	}
-}
-
-// processCounterMetric processes a counter metric
-func (mc *MosquittoCollector) processCounterMetric(metricName, payload string) {
-	value := parseValue(payload)
-	mc.metrics.SetCounterValue(metricName, value)
-}
-
-// processGaugeMetric processes a gauge metric
-func (mc *MosquittoCollector) processGaugeMetric(metricName, payload string) {
-	value := parseValue(payload)
-	mc.metrics.SetGaugeValue(metricName, value)
+	return inventories
 }
 
 // parseTopic converts an MQTT topic to a Prometheus metric name
@@ -248,18 +173,38 @@ func parseTopic(topic string) string {
 	return name
 }
 
-// parseValue extracts a numeric value from a payload string
+// validValue matches the first number in a payload
+var validValue = regexp.MustCompile(`-?\d{1,}[.]\d{1,}|\d{1,}`)
+
+// parseValue extracts a numeric value from a payload string, or 0 if it has none
 func parseValue(payload string) float64 {
-	var validValue = regexp.MustCompile(`-?\d{1,}[.]\d{1,}|\d{1,}`)
+	value, _ := parseNumber(payload)
+	return value
+}
+
+// parseNumber extracts the first numeric value from a payload string and
+// reports whether there was one
+func parseNumber(payload string) (float64, bool) {
 	// Get the first value in the string
 	strArray := validValue.FindAllString(payload, 1)
 	if len(strArray) > 0 {
 		// Parse to float
 		value, err := strconv.ParseFloat(strArray[0], 64)
 		if err == nil {
-			return value
+			return value, true
 		}
 	}
 
-	return 0
+	return 0, false
+}
+
+// sysSubtree returns the first two levels of a $SYS topic below $SYS, such
+// as "broker/clients", used to break down message counts
+func sysSubtree(topic string) string {
+	levels := strings.SplitN(strings.TrimPrefix(topic, "$SYS/"), "/", 3)
+	if len(levels) > 2 {
+		levels = levels[:2]
+	}
+
+	return strings.Join(levels, "/")
 }
@@ -2,58 +2,512 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
+	"math"
 	"os"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/d0ugal/promexporter/config"
 	"gopkg.in/yaml.v3"
 )
 
+// labelNamePattern matches valid Prometheus label names
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabelNames lists label names the exporter sets itself and which
+// therefore cannot be used as static broker labels
+var reservedLabelNames = map[string]bool{
+	"broker":  true,
+	"version": true,
+}
+
 // MosquittoExporterConfig extends the base configuration with Mosquitto-specific settings
 type MosquittoExporterConfig struct {
 	config.BaseConfig
 
 	Mosquitto MosquittoConfig `yaml:"mosquitto"`
+	Endpoints EndpointsConfig `yaml:"endpoints"`
+	Readiness ReadinessConfig `yaml:"readiness"`
+	Probe     ProbeConfig     `yaml:"probe"`
 }
 
-// MosquittoConfig holds Mosquitto broker connection settings
+// MosquittoConfig holds Mosquitto broker connection settings.
+// The inline broker settings describe a single broker and are only used when
+// Brokers is empty.
 type MosquittoConfig struct {
-	BrokerEndpoint string                 `yaml:"broker_endpoint"`
-	Username       string                 `yaml:"username"`
-	Password       config.SensitiveString `yaml:"password"`
-	ClientID       string                 `yaml:"client_id"`
-	TLS            TLSConfig              `yaml:"tls"`
+	BrokerConfig `yaml:",inline"`
+
+	Brokers      []BrokerConfig    `yaml:"brokers"`
+	MetricNaming string            `yaml:"metric_naming"`
+	Expiry       ExpiryConfig      `yaml:"expiry"`
+	Reconnect    ReconnectConfig   `yaml:"reconnect"`
+	ErrorPolicy  ErrorPolicyConfig `yaml:"error_policy"`
+
+	// TopicMetrics turn values in the payloads of application topics into
+	// metrics, for every broker
+	TopicMetrics []TopicMetricConfig `yaml:"topic_metrics"`
+
+	// Traffic accounts the messages on application topics by topic prefix
+	Traffic TrafficConfig `yaml:"traffic"`
+
+	// TopicGroups record the distributions of messages on sets of
+	// application topics
+	TopicGroups []TopicGroupConfig `yaml:"topic_groups"`
+
+	// Retained takes a periodic census of the retained messages
+	Retained RetainedConfig `yaml:"retained"`
+
+	// RoundTrip measures how long the broker takes to deliver messages
+	RoundTrip RoundTripConfig `yaml:"round_trip"`
+}
+
+// RoundTripConfig controls the synthetic publish/subscribe probe, which
+// periodically publishes a message to a topic with a separate client and
+// measures how long the broker takes to deliver it back
+type RoundTripConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Topic is published to and subscribed to; it must not have wildcards
+	Topic    string          `yaml:"topic"`
+	Interval config.Duration `yaml:"interval"`
+	// Timeout bounds connecting and the delivery of a message
+	Timeout config.Duration `yaml:"timeout"`
+	// QoS are the levels a message is published with in every interval
+	QoS []int `yaml:"qos"`
+}
+
+// RetainedConfig controls the periodic census of retained messages, taken
+// by subscribing with a separate client and counting the retained messages
+// the broker sends
+type RetainedConfig struct {
+	Enabled  bool            `yaml:"enabled"`
+	Interval config.Duration `yaml:"interval"`
+	// Timeout bounds a census, including connecting
+	Timeout config.Duration `yaml:"timeout"`
+	// Topics are the topic filters subscribed to, by default "#"
+	Topics []string `yaml:"topics"`
+	// PrefixDepth and MaxPrefixes aggregate the messages as for TrafficConfig
+	PrefixDepth int `yaml:"prefix_depth"`
+	MaxPrefixes int `yaml:"max_prefixes"`
+	// TimestampField selects the time a message was published in JSON
+	// payloads, as Unix seconds or milliseconds or an RFC 3339 string. The
+	// ages of messages are only recorded if it is set.
+	TimestampField string `yaml:"timestamp_field"`
+	// AgeBuckets are the upper bounds of the age histogram
+	AgeBuckets []config.Duration `yaml:"age_buckets"`
+}
+
+// TopicGroupConfig names a set of application topics whose payload sizes,
+// inter-arrival times, QoS and retain flags are recorded
+type TopicGroupConfig struct {
+	// Name is the value of the group label
+	Name string `yaml:"name"`
+	// Topics are the topic filters of the group's topics
+	Topics []string `yaml:"topics"`
+}
+
+// TrafficConfig controls the accounting of messages and payload bytes on
+// application topics by topic prefix
+type TrafficConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Topics are the topic filters subscribed to, by default "#"
+	Topics []string `yaml:"topics"`
+	// PrefixDepth is the number of topic levels traffic is aggregated by
+	PrefixDepth int `yaml:"prefix_depth"`
+	// MaxPrefixes caps the number of prefixes per broker, including "other",
+	// which the traffic of further prefixes is accounted to
+	MaxPrefixes int `yaml:"max_prefixes"`
+}
+
+// TopicMetricConfig maps messages on application topics to a metric
+type TopicMetricConfig struct {
+	// Topic is an MQTT topic filter. Levels of the form "+name" match any
+	// single level and export it as the label "name"; a final "#name" exports
+	// the remaining levels.
+	Topic string `yaml:"topic"`
+
+	// Value selects the number in a JSON payload, e.g. "$.sensors[0].value"
+	// or "temperature". Without it the payload itself is parsed as a number.
+	Value string `yaml:"value"`
+
+	Metric string `yaml:"metric"`
+	Help   string `yaml:"help"`
+
+	// Type is "gauge" (the default) or "counter" for values that only increase
+	Type string `yaml:"type"`
+}
+
+// ErrorPolicyConfig decides which connection errors are worth retrying
+type ErrorPolicyConfig struct {
+	// FatalClasses are the error classes that make the exporter exit when a
+	// broker fails with them before it was ever connected, as retrying won't
+	// help. Errors of other classes, and any error once a broker has been
+	// connected, are retried. None are fatal by default.
+	FatalClasses []string `yaml:"fatal_classes"`
+}
+
+// IsFatal returns true if errors of the given class are fatal
+func (p *ErrorPolicyConfig) IsFatal(class string) bool {
+	return slices.Contains(p.FatalClasses, class)
+}
+
+// ReconnectConfig controls how often the exporter tries to connect to a
+// broker that is unreachable or has dropped the connection
+type ReconnectConfig struct {
+	// InitialBackoff is the delay after the first failed attempt; it doubles
+	// with every further failure up to MaxBackoff
+	InitialBackoff config.Duration `yaml:"initial_backoff"`
+	MaxBackoff     config.Duration `yaml:"max_backoff"`
+	// Jitter randomises each delay by up to this fraction of it
+	Jitter float64 `yaml:"jitter"`
+	// ConnectTimeout bounds a single attempt, including the MQTT handshake
+	ConnectTimeout config.Duration `yaml:"connect_timeout"`
+}
+
+// ExpiryConfig controls when series derived from a broker's $SYS topics are
+// removed, so stale values aren't exported indefinitely
+type ExpiryConfig struct {
+	// DropOnDisconnect removes a broker's series when the connection is lost
+	DropOnDisconnect bool `yaml:"drop_on_disconnect"`
+	// SysInterval is the broker's sys_interval setting
+	SysInterval config.Duration `yaml:"sys_interval"`
+	// Intervals is the number of sys_intervals after which a series that
+	// hasn't been updated is removed; 0 disables expiry
+	Intervals int `yaml:"intervals"`
+}
+
+// BrokerConfig holds the connection settings for a single Mosquitto broker
+type BrokerConfig struct {
+	Name           string            `yaml:"name"`
+	BrokerEndpoint string            `yaml:"broker_endpoint"`
+	Username       string            `yaml:"username"`
+	Password       Secret            `yaml:"password"`
+	ClientID       string            `yaml:"client_id"`
+	TLS            TLSConfig         `yaml:"tls"`
+	WebSocket      WebSocketConfig   `yaml:"websocket"`
+	Proxy          ProxyConfig       `yaml:"proxy"`
+	Labels         map[string]string `yaml:"labels"`
+	LogFile        string            `yaml:"log_file"`
+
+	// ProtocolVersion selects MQTT 3.1 (3), 3.1.1 (4) or 5. The default
+	// negotiates 3.1.1, falling back to 3.1.
+	ProtocolVersion int `yaml:"protocol_version"`
+
+	// SessionExpiry and UserProperties are sent when connecting with MQTT v5
+	SessionExpiry  config.Duration   `yaml:"session_expiry"`
+	UserProperties map[string]string `yaml:"user_properties"`
+}
+
+// WebSocketConfig holds the HTTP settings used for ws:// and wss:// endpoints
+type WebSocketConfig struct {
+	// Path is the HTTP path of the broker's WebSocket listener, used when
+	// the endpoint URL doesn't include one
+	Path    string            `yaml:"path"`
+	Origin  string            `yaml:"origin"`
+	Headers map[string]Secret `yaml:"headers"`
+}
+
+// ProxyConfig holds the HTTP CONNECT or SOCKS5 proxy used to reach a broker
+type ProxyConfig struct {
+	// URL is the proxy address, e.g. http://proxy:3128 or socks5://proxy:1080
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password Secret `yaml:"password"`
+}
+
+// EndpointsConfig holds the listen address of the exporter's additional HTTP
+// endpoints (such as /ready), which are served separately from /metrics.
+// The listener is opened unless disabled.
+type EndpointsConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Host    string `yaml:"host"`
+	Port    int    `yaml:"port"`
+}
+
+// ReadinessConfig holds the thresholds of the /ready endpoint
+type ReadinessConfig struct {
+	// MaxMessageAge is how long a broker may go without a $SYS message before
+	// the exporter is no longer ready
+	MaxMessageAge config.Duration `yaml:"max_message_age"`
+}
+
+// ProbeConfig holds settings for the blackbox-style /probe endpoint
+type ProbeConfig struct {
+	Enabled bool                   `yaml:"enabled"`
+	Modules map[string]ProbeModule `yaml:"modules"`
+}
+
+// ProbeModule is a named credential and TLS profile used to probe a target
+type ProbeModule struct {
+	Username  string          `yaml:"username"`
+	Password  Secret          `yaml:"password"`
+	ClientID  string          `yaml:"client_id"`
+	TLS       TLSConfig       `yaml:"tls"`
+	WebSocket WebSocketConfig `yaml:"websocket"`
+	Proxy     ProxyConfig     `yaml:"proxy"`
+	Timeout   config.Duration `yaml:"timeout"`
+
+	ProtocolVersion int               `yaml:"protocol_version"`
+	UserProperties  map[string]string `yaml:"user_properties"`
+}
+
+// BrokerConfig returns the broker settings used to probe target with this module
+func (m *ProbeModule) BrokerConfig(target string) *BrokerConfig {
+	return &BrokerConfig{
+		Name:            target,
+		BrokerEndpoint:  target,
+		Username:        m.Username,
+		Password:        m.Password,
+		ClientID:        m.ClientID,
+		TLS:             m.TLS,
+		WebSocket:       m.WebSocket,
+		Proxy:           m.Proxy,
+		ProtocolVersion: m.ProtocolVersion,
+		UserProperties:  m.UserProperties,
+	}
+}
+
+// Secret is a config.SensitiveString that can also be decoded from YAML
+type Secret struct {
+	config.SensitiveString
+}
+
+// NewSecret creates a new Secret with the given value
+func NewSecret(value string) Secret {
+	return Secret{config.NewSensitiveString(value)}
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (s *Secret) UnmarshalYAML(node *yaml.Node) error {
+	var value string
+	if err := node.Decode(&value); err != nil {
+		return err
+	}
+
+	*s = NewSecret(value)
+
+	return nil
 }
 
 // TLSConfig holds TLS/SSL settings
 type TLSConfig struct {
-	Enabled            bool   `yaml:"enabled"`
-	CertFile           string `yaml:"cert_file"`
-	KeyFile            string `yaml:"key_file"`
-	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	Enabled            bool     `yaml:"enabled"`
+	CAFile             string   `yaml:"ca_file"`
+	CADir              string   `yaml:"ca_dir"`
+	CertFile           string   `yaml:"cert_file"`
+	KeyFile            string   `yaml:"key_file"`
+	PKCS12File         string   `yaml:"pkcs12_file"`
+	KeyPassword        Secret   `yaml:"key_password"`
+	KeyPasswordFile    string   `yaml:"key_password_file"`
+	ServerName         string   `yaml:"server_name"`
+	MinVersion         string   `yaml:"min_version"`
+	MaxVersion         string   `yaml:"max_version"`
+	CipherSuites       []string `yaml:"cipher_suites"`
+	ALPNProtocols      []string `yaml:"alpn_protocols"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
 }
 
 // GetDisplayConfig returns the configuration for display in the web UI
 func (c *MosquittoExporterConfig) GetDisplayConfig() map[string]interface{} {
 	cfg := c.BaseConfig.GetDisplayConfig()
-	cfg["Mosquitto Broker"] = c.Mosquitto.BrokerEndpoint
-	cfg["MQTT Username"] = c.Mosquitto.Username
-	cfg["MQTT Client ID"] = c.Mosquitto.ClientID
 
-	cfg["TLS Enabled"] = c.Mosquitto.TLS.Enabled
-	if c.Mosquitto.TLS.Enabled {
-		cfg["TLS Certificate"] = c.Mosquitto.TLS.CertFile
-		cfg["TLS Key File"] = c.Mosquitto.TLS.KeyFile
-		cfg["TLS Skip Verify"] = c.Mosquitto.TLS.InsecureSkipVerify
+	for i := range c.Mosquitto.Brokers {
+		broker := &c.Mosquitto.Brokers[i]
+		prefix := fmt.Sprintf("Broker %s: ", broker.Name)
+
+		cfg[prefix+"Endpoint"] = broker.BrokerEndpoint
+		cfg[prefix+"MQTT Username"] = broker.Username
+		cfg[prefix+"MQTT Client ID"] = broker.ClientID
+
+		if len(broker.Labels) > 0 {
+			cfg[prefix+"Labels"] = broker.Labels
+		}
+
+		if broker.LogFile != "" {
+			cfg[prefix+"Log File"] = broker.LogFile
+		}
+
+		if broker.WebSocket.Path != "" {
+			cfg[prefix+"WebSocket Path"] = broker.WebSocket.Path
+		}
+
+		if broker.WebSocket.Origin != "" {
+			cfg[prefix+"WebSocket Origin"] = broker.WebSocket.Origin
+		}
+
+		if len(broker.WebSocket.Headers) > 0 {
+			headers := make([]string, 0, len(broker.WebSocket.Headers))
+			for name := range broker.WebSocket.Headers {
+				headers = append(headers, name)
+			}
+
+			sort.Strings(headers)
+
+			cfg[prefix+"WebSocket Headers"] = headers
+		}
+
+		if broker.ProtocolVersion != 0 {
+			cfg[prefix+"MQTT Protocol Version"] = broker.ProtocolVersion
+		}
+
+		if broker.SessionExpiry.Duration > 0 {
+			cfg[prefix+"MQTT Session Expiry"] = broker.SessionExpiry.Duration.String()
+		}
+
+		if len(broker.UserProperties) > 0 {
+			cfg[prefix+"MQTT User Properties"] = broker.UserProperties
+		}
+
+		if broker.Proxy.URL != "" {
+			cfg[prefix+"Proxy"] = redactProxyURL(broker.Proxy.URL)
+			cfg[prefix+"Proxy Username"] = broker.Proxy.Username
+		}
+
+		cfg[prefix+"TLS Enabled"] = broker.TLS.Enabled
+		if broker.TLS.Enabled {
+			cfg[prefix+"TLS CA File"] = broker.TLS.CAFile
+			cfg[prefix+"TLS CA Directory"] = broker.TLS.CADir
+			cfg[prefix+"TLS Certificate"] = broker.TLS.CertFile
+			cfg[prefix+"TLS Key File"] = broker.TLS.KeyFile
+			cfg[prefix+"TLS PKCS#12 File"] = broker.TLS.PKCS12File
+			cfg[prefix+"TLS Key Password Set"] = !broker.TLS.KeyPassword.IsEmpty() || broker.TLS.KeyPasswordFile != ""
+			cfg[prefix+"TLS Server Name"] = broker.TLS.ServerName
+			cfg[prefix+"TLS Min Version"] = broker.TLS.MinVersion
+			cfg[prefix+"TLS Max Version"] = broker.TLS.MaxVersion
+			cfg[prefix+"TLS Cipher Suites"] = strings.Join(broker.TLS.CipherSuites, ", ")
+			cfg[prefix+"TLS ALPN Protocols"] = strings.Join(broker.TLS.ALPNProtocols, ", ")
+			cfg[prefix+"TLS Skip Verify"] = broker.TLS.InsecureSkipVerify
+		}
+	}
+
+	cfg["Metric Naming"] = c.Mosquitto.MetricNaming
+
+	if len(c.Mosquitto.TopicMetrics) > 0 {
+		rules := make([]string, 0, len(c.Mosquitto.TopicMetrics))
+		for _, rule := range c.Mosquitto.TopicMetrics {
+			rules = append(rules, fmt.Sprintf("%s <- %s %s", rule.Metric, rule.Topic, rule.Value))
+		}
+
+		cfg["Topic Metrics"] = rules
+	}
+
+	cfg["Traffic Accounting"] = c.Mosquitto.Traffic.Enabled
+
+	if c.Mosquitto.Traffic.Enabled {
+		cfg["Traffic Topics"] = strings.Join(c.Mosquitto.Traffic.Topics, ", ")
+		cfg["Traffic Prefix Depth"] = c.Mosquitto.Traffic.PrefixDepth
+		cfg["Traffic Max Prefixes"] = c.Mosquitto.Traffic.MaxPrefixes
+	}
+
+	if len(c.Mosquitto.TopicGroups) > 0 {
+		groups := make([]string, 0, len(c.Mosquitto.TopicGroups))
+		for _, group := range c.Mosquitto.TopicGroups {
+			groups = append(groups, fmt.Sprintf("%s: %s", group.Name, strings.Join(group.Topics, ", ")))
+		}
+
+		cfg["Topic Groups"] = groups
+	}
+
+	cfg["Retained Census"] = c.Mosquitto.Retained.Enabled
+
+	if c.Mosquitto.Retained.Enabled {
+		cfg["Retained Census Interval"] = c.Mosquitto.Retained.Interval.Duration.String()
+		cfg["Retained Census Topics"] = strings.Join(c.Mosquitto.Retained.Topics, ", ")
+		cfg["Retained Census Prefix Depth"] = c.Mosquitto.Retained.PrefixDepth
+		cfg["Retained Census Timestamp Field"] = c.Mosquitto.Retained.TimestampField
+	}
+
+	cfg["Round-Trip Probe"] = c.Mosquitto.RoundTrip.Enabled
+
+	if c.Mosquitto.RoundTrip.Enabled {
+		cfg["Round-Trip Probe Topic"] = c.Mosquitto.RoundTrip.Topic
+		cfg["Round-Trip Probe Interval"] = c.Mosquitto.RoundTrip.Interval.Duration.String()
+		cfg["Round-Trip Probe QoS"] = fmt.Sprint(c.Mosquitto.RoundTrip.QoS)
+	}
+
+	cfg["Drop Series On Disconnect"] = c.Mosquitto.Expiry.DropOnDisconnect
+
+	if c.Mosquitto.Expiry.Intervals > 0 {
+		cfg["Series Expiry"] = (time.Duration(c.Mosquitto.Expiry.Intervals) * c.Mosquitto.Expiry.SysInterval.Duration).String()
+	}
+
+	cfg["Reconnect Backoff"] = fmt.Sprintf("%s to %s (jitter %g)", c.Mosquitto.Reconnect.InitialBackoff.Duration, c.Mosquitto.Reconnect.MaxBackoff.Duration, c.Mosquitto.Reconnect.Jitter)
+	cfg["Connect Timeout"] = c.Mosquitto.Reconnect.ConnectTimeout.Duration.String()
+	cfg["Fatal Error Classes"] = strings.Join(c.Mosquitto.ErrorPolicy.FatalClasses, ", ")
+
+	cfg["Endpoints Enabled"] = c.Endpoints.Enabled
+
+	if c.Endpoints.Enabled {
+		cfg["Endpoints Address"] = fmt.Sprintf("%s:%d", c.Endpoints.Host, c.Endpoints.Port)
+	}
+
+	cfg["Readiness Max Message Age"] = c.Readiness.MaxMessageAge.Duration.String()
+
+	if c.Probe.Enabled {
+		modules := make([]string, 0, len(c.Probe.Modules))
+		for name := range c.Probe.Modules {
+			modules = append(modules, name)
+		}
+
+		sort.Strings(modules)
+
+		cfg["Probe Modules"] = modules
 	}
 
+	cfg["Probe Enabled"] = c.Probe.Enabled
+
 	return cfg
 }
 
+// LabelNames returns the label names attached to every broker-derived metric:
+// "broker" followed by the sorted union of all static broker label names.
+func (c *MosquittoConfig) LabelNames() []string {
+	seen := make(map[string]bool)
+
+	var static []string
+
+	for _, broker := range c.Brokers {
+		for name := range broker.Labels {
+			if !seen[name] {
+				seen[name] = true
+				static = append(static, name)
+			}
+		}
+	}
+
+	sort.Strings(static)
+
+	return append([]string{"broker"}, static...)
+}
+
+// LabelValues returns the values for the given label names for this broker.
+// Static labels the broker does not define are exported as empty strings.
+func (b *BrokerConfig) LabelValues(labelNames []string) []string {
+	values := make([]string, len(labelNames))
+
+	for i, name := range labelNames {
+		if name == "broker" {
+			values[i] = b.Name
+		} else {
+			values[i] = b.Labels[name]
+		}
+	}
+
+	return values
+}
+
 // LoadConfig loads configuration from an optional YAML file, then overlays environment variables.
 func LoadConfig(configPath string) (*MosquittoExporterConfig, error) {
 	var cfg MosquittoExporterConfig
 
+	// Defaults that can't be told apart from an explicit zero are set before decoding
+	cfg.Mosquitto.Reconnect.Jitter = 0.2
+	cfg.Endpoints.Enabled = true
+
 	// Try to load from YAML (optional — silently skip if file not found)
 	if configPath != "" {
 		data, err := os.ReadFile(configPath)
@@ -77,10 +531,15 @@ func LoadConfig(configPath string) (*MosquittoExporterConfig, error) {
 
 	setDefaults(&cfg)
 
+	if err := validateConfig(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
 	return &cfg, nil
 }
 
-// applyMosquittoEnvVars applies Mosquitto-specific environment variables
+// applyMosquittoEnvVars applies Mosquitto-specific environment variables.
+// They configure the single inline broker and have no effect on mosquitto.brokers.
 func applyMosquittoEnvVars(cfg *MosquittoExporterConfig) error {
 	// Broker endpoint - support both new and legacy env var names
 	if endpoint := getEnv("MOSQUITTO_BROKER_ENDPOINT", "BROKER_ENDPOINT"); endpoint != "" {
@@ -94,7 +553,7 @@ func applyMosquittoEnvVars(cfg *MosquittoExporterConfig) error {
 
 	// Password - support both new and legacy env var names
 	if password := getEnv("MOSQUITTO_PASSWORD", "MQTT_PASS"); password != "" {
-		cfg.Mosquitto.Password = config.NewSensitiveString(password)
+		cfg.Mosquitto.Password = NewSecret(password)
 	}
 
 	// Client ID - support both new and legacy env var names
@@ -120,6 +579,50 @@ func applyMosquittoEnvVars(cfg *MosquittoExporterConfig) error {
 		cfg.Mosquitto.TLS.Enabled = true
 	}
 
+	if pkcs12File := os.Getenv("MOSQUITTO_TLS_PKCS12_FILE"); pkcs12File != "" {
+		cfg.Mosquitto.TLS.PKCS12File = pkcs12File
+		cfg.Mosquitto.TLS.Enabled = true
+	}
+
+	if keyPassword := os.Getenv("MOSQUITTO_TLS_KEY_PASSWORD"); keyPassword != "" {
+		cfg.Mosquitto.TLS.KeyPassword = NewSecret(keyPassword)
+	}
+
+	if keyPasswordFile := os.Getenv("MOSQUITTO_TLS_KEY_PASSWORD_FILE"); keyPasswordFile != "" {
+		cfg.Mosquitto.TLS.KeyPasswordFile = keyPasswordFile
+	}
+
+	if caFile := os.Getenv("MOSQUITTO_TLS_CA_FILE"); caFile != "" {
+		cfg.Mosquitto.TLS.CAFile = caFile
+		cfg.Mosquitto.TLS.Enabled = true
+	}
+
+	if caDir := os.Getenv("MOSQUITTO_TLS_CA_DIR"); caDir != "" {
+		cfg.Mosquitto.TLS.CADir = caDir
+		cfg.Mosquitto.TLS.Enabled = true
+	}
+
+	if serverName := os.Getenv("MOSQUITTO_TLS_SERVER_NAME"); serverName != "" {
+		cfg.Mosquitto.TLS.ServerName = serverName
+		cfg.Mosquitto.TLS.Enabled = true
+	}
+
+	if minVersion := os.Getenv("MOSQUITTO_TLS_MIN_VERSION"); minVersion != "" {
+		cfg.Mosquitto.TLS.MinVersion = minVersion
+	}
+
+	if maxVersion := os.Getenv("MOSQUITTO_TLS_MAX_VERSION"); maxVersion != "" {
+		cfg.Mosquitto.TLS.MaxVersion = maxVersion
+	}
+
+	if cipherSuites := os.Getenv("MOSQUITTO_TLS_CIPHER_SUITES"); cipherSuites != "" {
+		cfg.Mosquitto.TLS.CipherSuites = splitList(cipherSuites)
+	}
+
+	if alpn := os.Getenv("MOSQUITTO_TLS_ALPN_PROTOCOLS"); alpn != "" {
+		cfg.Mosquitto.TLS.ALPNProtocols = splitList(alpn)
+	}
+
 	if skipVerify := os.Getenv("MOSQUITTO_TLS_INSECURE_SKIP_VERIFY"); skipVerify != "" {
 		if val, err := strconv.ParseBool(skipVerify); err == nil {
 			cfg.Mosquitto.TLS.InsecureSkipVerify = val
@@ -127,6 +630,259 @@ func applyMosquittoEnvVars(cfg *MosquittoExporterConfig) error {
 		}
 	}
 
+	if wsPath := os.Getenv("MOSQUITTO_WEBSOCKET_PATH"); wsPath != "" {
+		cfg.Mosquitto.WebSocket.Path = wsPath
+	}
+
+	if wsOrigin := os.Getenv("MOSQUITTO_WEBSOCKET_ORIGIN"); wsOrigin != "" {
+		cfg.Mosquitto.WebSocket.Origin = wsOrigin
+	}
+
+	if wsHeaders := os.Getenv("MOSQUITTO_WEBSOCKET_HEADERS"); wsHeaders != "" {
+		headers, err := parseHeaders(wsHeaders)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_WEBSOCKET_HEADERS: %w", err)
+		}
+
+		cfg.Mosquitto.WebSocket.Headers = headers
+	}
+
+	if proxyURL := os.Getenv("MOSQUITTO_PROXY_URL"); proxyURL != "" {
+		cfg.Mosquitto.Proxy.URL = proxyURL
+	}
+
+	if proxyUsername := os.Getenv("MOSQUITTO_PROXY_USERNAME"); proxyUsername != "" {
+		cfg.Mosquitto.Proxy.Username = proxyUsername
+	}
+
+	if proxyPassword := os.Getenv("MOSQUITTO_PROXY_PASSWORD"); proxyPassword != "" {
+		cfg.Mosquitto.Proxy.Password = NewSecret(proxyPassword)
+	}
+
+	if protocolVersion := os.Getenv("MOSQUITTO_PROTOCOL_VERSION"); protocolVersion != "" {
+		val, err := strconv.Atoi(protocolVersion)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_PROTOCOL_VERSION: %w", err)
+		}
+
+		cfg.Mosquitto.ProtocolVersion = val
+	}
+
+	if sessionExpiry := os.Getenv("MOSQUITTO_SESSION_EXPIRY"); sessionExpiry != "" {
+		val, err := time.ParseDuration(sessionExpiry)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_SESSION_EXPIRY: %w", err)
+		}
+
+		cfg.Mosquitto.SessionExpiry.Duration = val
+	}
+
+	if userProperties := os.Getenv("MOSQUITTO_USER_PROPERTIES"); userProperties != "" {
+		props, err := parseKeyValues(userProperties)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_USER_PROPERTIES: %w", err)
+		}
+
+		cfg.Mosquitto.UserProperties = props
+	}
+
+	if logFile := os.Getenv("MOSQUITTO_LOG_FILE"); logFile != "" {
+		cfg.Mosquitto.LogFile = logFile
+	}
+
+	if naming := os.Getenv("MOSQUITTO_METRIC_NAMING"); naming != "" {
+		cfg.Mosquitto.MetricNaming = naming
+	}
+
+	if drop := os.Getenv("MOSQUITTO_EXPIRY_DROP_ON_DISCONNECT"); drop != "" {
+		if val, err := strconv.ParseBool(drop); err == nil {
+			cfg.Mosquitto.Expiry.DropOnDisconnect = val
+		}
+	}
+
+	if sysInterval := os.Getenv("MOSQUITTO_SYS_INTERVAL"); sysInterval != "" {
+		val, err := time.ParseDuration(sysInterval)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_SYS_INTERVAL: %w", err)
+		}
+
+		cfg.Mosquitto.Expiry.SysInterval.Duration = val
+	}
+
+	if intervals := os.Getenv("MOSQUITTO_EXPIRY_INTERVALS"); intervals != "" {
+		val, err := strconv.Atoi(intervals)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_EXPIRY_INTERVALS: %w", err)
+		}
+
+		cfg.Mosquitto.Expiry.Intervals = val
+	}
+
+	if initialBackoff := os.Getenv("MOSQUITTO_RECONNECT_INITIAL_BACKOFF"); initialBackoff != "" {
+		val, err := time.ParseDuration(initialBackoff)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_RECONNECT_INITIAL_BACKOFF: %w", err)
+		}
+
+		cfg.Mosquitto.Reconnect.InitialBackoff.Duration = val
+	}
+
+	if maxBackoff := os.Getenv("MOSQUITTO_RECONNECT_MAX_BACKOFF"); maxBackoff != "" {
+		val, err := time.ParseDuration(maxBackoff)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_RECONNECT_MAX_BACKOFF: %w", err)
+		}
+
+		cfg.Mosquitto.Reconnect.MaxBackoff.Duration = val
+	}
+
+	if connectTimeout := os.Getenv("MOSQUITTO_CONNECT_TIMEOUT"); connectTimeout != "" {
+		val, err := time.ParseDuration(connectTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_CONNECT_TIMEOUT: %w", err)
+		}
+
+		cfg.Mosquitto.Reconnect.ConnectTimeout.Duration = val
+	}
+
+	if jitter := os.Getenv("MOSQUITTO_RECONNECT_JITTER"); jitter != "" {
+		val, err := strconv.ParseFloat(jitter, 64)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_RECONNECT_JITTER: %w", err)
+		}
+
+		cfg.Mosquitto.Reconnect.Jitter = val
+	}
+
+	if fatalClasses := os.Getenv("MOSQUITTO_FATAL_ERROR_CLASSES"); fatalClasses != "" {
+		// "none" retries every error
+		cfg.Mosquitto.ErrorPolicy.FatalClasses = slices.DeleteFunc(splitList(fatalClasses), func(class string) bool {
+			return class == "none"
+		})
+	}
+
+	if trafficEnabled := os.Getenv("MOSQUITTO_TRAFFIC_ENABLED"); trafficEnabled != "" {
+		if val, err := strconv.ParseBool(trafficEnabled); err == nil {
+			cfg.Mosquitto.Traffic.Enabled = val
+		}
+	}
+
+	if trafficTopics := os.Getenv("MOSQUITTO_TRAFFIC_TOPICS"); trafficTopics != "" {
+		cfg.Mosquitto.Traffic.Topics = splitList(trafficTopics)
+	}
+
+	if prefixDepth := os.Getenv("MOSQUITTO_TRAFFIC_PREFIX_DEPTH"); prefixDepth != "" {
+		val, err := strconv.Atoi(prefixDepth)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_TRAFFIC_PREFIX_DEPTH: %w", err)
+		}
+
+		cfg.Mosquitto.Traffic.PrefixDepth = val
+	}
+
+	if maxPrefixes := os.Getenv("MOSQUITTO_TRAFFIC_MAX_PREFIXES"); maxPrefixes != "" {
+		val, err := strconv.Atoi(maxPrefixes)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_TRAFFIC_MAX_PREFIXES: %w", err)
+		}
+
+		cfg.Mosquitto.Traffic.MaxPrefixes = val
+	}
+
+	if retainedEnabled := os.Getenv("MOSQUITTO_RETAINED_ENABLED"); retainedEnabled != "" {
+		if val, err := strconv.ParseBool(retainedEnabled); err == nil {
+			cfg.Mosquitto.Retained.Enabled = val
+		}
+	}
+
+	if retainedInterval := os.Getenv("MOSQUITTO_RETAINED_INTERVAL"); retainedInterval != "" {
+		val, err := time.ParseDuration(retainedInterval)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_RETAINED_INTERVAL: %w", err)
+		}
+
+		cfg.Mosquitto.Retained.Interval.Duration = val
+	}
+
+	if retainedTopics := os.Getenv("MOSQUITTO_RETAINED_TOPICS"); retainedTopics != "" {
+		cfg.Mosquitto.Retained.Topics = splitList(retainedTopics)
+	}
+
+	if prefixDepth := os.Getenv("MOSQUITTO_RETAINED_PREFIX_DEPTH"); prefixDepth != "" {
+		val, err := strconv.Atoi(prefixDepth)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_RETAINED_PREFIX_DEPTH: %w", err)
+		}
+
+		cfg.Mosquitto.Retained.PrefixDepth = val
+	}
+
+	if timestampField := os.Getenv("MOSQUITTO_RETAINED_TIMESTAMP_FIELD"); timestampField != "" {
+		cfg.Mosquitto.Retained.TimestampField = timestampField
+	}
+
+	if roundTripEnabled := os.Getenv("MOSQUITTO_ROUNDTRIP_ENABLED"); roundTripEnabled != "" {
+		if val, err := strconv.ParseBool(roundTripEnabled); err == nil {
+			cfg.Mosquitto.RoundTrip.Enabled = val
+		}
+	}
+
+	if roundTripTopic := os.Getenv("MOSQUITTO_ROUNDTRIP_TOPIC"); roundTripTopic != "" {
+		cfg.Mosquitto.RoundTrip.Topic = roundTripTopic
+	}
+
+	if roundTripInterval := os.Getenv("MOSQUITTO_ROUNDTRIP_INTERVAL"); roundTripInterval != "" {
+		val, err := time.ParseDuration(roundTripInterval)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_ROUNDTRIP_INTERVAL: %w", err)
+		}
+
+		cfg.Mosquitto.RoundTrip.Interval.Duration = val
+	}
+
+	if roundTripTimeout := os.Getenv("MOSQUITTO_ROUNDTRIP_TIMEOUT"); roundTripTimeout != "" {
+		val, err := time.ParseDuration(roundTripTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_ROUNDTRIP_TIMEOUT: %w", err)
+		}
+
+		cfg.Mosquitto.RoundTrip.Timeout.Duration = val
+	}
+
+	if roundTripQoS := os.Getenv("MOSQUITTO_ROUNDTRIP_QOS"); roundTripQoS != "" {
+		cfg.Mosquitto.RoundTrip.QoS = nil
+
+		for _, item := range splitList(roundTripQoS) {
+			val, err := strconv.Atoi(item)
+			if err != nil {
+				return fmt.Errorf("invalid MOSQUITTO_ROUNDTRIP_QOS: %w", err)
+			}
+
+			cfg.Mosquitto.RoundTrip.QoS = append(cfg.Mosquitto.RoundTrip.QoS, val)
+		}
+	}
+
+	if maxMessageAge := os.Getenv("MOSQUITTO_READINESS_MAX_MESSAGE_AGE"); maxMessageAge != "" {
+		val, err := time.ParseDuration(maxMessageAge)
+		if err != nil {
+			return fmt.Errorf("invalid MOSQUITTO_READINESS_MAX_MESSAGE_AGE: %w", err)
+		}
+
+		cfg.Readiness.MaxMessageAge.Duration = val
+	}
+
+	if endpointsEnabled := os.Getenv("MOSQUITTO_ENDPOINTS_ENABLED"); endpointsEnabled != "" {
+		if val, err := strconv.ParseBool(endpointsEnabled); err == nil {
+			cfg.Endpoints.Enabled = val
+		}
+	}
+
+	if probeEnabled := os.Getenv("MOSQUITTO_PROBE_ENABLED"); probeEnabled != "" {
+		if val, err := strconv.ParseBool(probeEnabled); err == nil {
+			cfg.Probe.Enabled = val
+		}
+	}
+
 	// Server bind address - legacy BIND_ADDRESS support
 	if bindAddress := os.Getenv("BIND_ADDRESS"); bindAddress != "" {
 		// Parse bind address (format: host:port)
@@ -145,9 +901,106 @@ func applyMosquittoEnvVars(cfg *MosquittoExporterConfig) error {
 
 // setDefaults sets default values for unconfigured options
 func setDefaults(cfg *MosquittoExporterConfig) {
-	// Mosquitto defaults
-	if cfg.Mosquitto.BrokerEndpoint == "" {
-		cfg.Mosquitto.BrokerEndpoint = "tcp://127.0.0.1:1883"
+	// Mosquitto defaults - a config without a brokers list describes a single broker
+	if len(cfg.Mosquitto.Brokers) == 0 {
+		if cfg.Mosquitto.BrokerEndpoint == "" {
+			cfg.Mosquitto.BrokerEndpoint = "tcp://127.0.0.1:1883"
+		}
+
+		cfg.Mosquitto.Brokers = []BrokerConfig{cfg.Mosquitto.BrokerConfig}
+	} else if cfg.Mosquitto.BrokerEndpoint != "" {
+		slog.Warn("mosquitto.broker_endpoint is ignored because mosquitto.brokers is set",
+			"broker_endpoint", cfg.Mosquitto.BrokerEndpoint,
+		)
+	}
+
+	for i := range cfg.Mosquitto.Brokers {
+		if cfg.Mosquitto.Brokers[i].Name == "" {
+			cfg.Mosquitto.Brokers[i].Name = cfg.Mosquitto.Brokers[i].BrokerEndpoint
+		}
+	}
+
+	if cfg.Mosquitto.MetricNaming == "" {
+		cfg.Mosquitto.MetricNaming = NamingLegacy
+	}
+
+	// Mosquitto publishes $SYS topics every 10 seconds by default
+	if cfg.Mosquitto.Expiry.SysInterval.Duration == 0 {
+		cfg.Mosquitto.Expiry.SysInterval.Duration = 10 * time.Second
+	}
+
+	if len(cfg.Mosquitto.Traffic.Topics) == 0 {
+		cfg.Mosquitto.Traffic.Topics = []string{"#"}
+	}
+
+	if cfg.Mosquitto.Traffic.PrefixDepth == 0 {
+		cfg.Mosquitto.Traffic.PrefixDepth = 2
+	}
+
+	if cfg.Mosquitto.Traffic.MaxPrefixes == 0 {
+		cfg.Mosquitto.Traffic.MaxPrefixes = 1000
+	}
+
+	retained := &cfg.Mosquitto.Retained
+	if retained.Interval.Duration == 0 {
+		retained.Interval.Duration = 5 * time.Minute
+	}
+
+	if retained.Timeout.Duration == 0 {
+		retained.Timeout.Duration = min(30*time.Second, retained.Interval.Duration)
+	}
+
+	if len(retained.Topics) == 0 {
+		retained.Topics = []string{"#"}
+	}
+
+	if retained.PrefixDepth == 0 {
+		retained.PrefixDepth = 2
+	}
+
+	if retained.MaxPrefixes == 0 {
+		retained.MaxPrefixes = 1000
+	}
+
+	// From an hour to three months
+	if len(retained.AgeBuckets) == 0 {
+		for _, age := range []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour, 30 * 24 * time.Hour, 90 * 24 * time.Hour} {
+			retained.AgeBuckets = append(retained.AgeBuckets, config.Duration{Duration: age})
+		}
+	}
+
+	roundTrip := &cfg.Mosquitto.RoundTrip
+	if roundTrip.Topic == "" {
+		roundTrip.Topic = "mosquitto-exporter/roundtrip"
+	}
+
+	if roundTrip.Interval.Duration == 0 {
+		roundTrip.Interval.Duration = 30 * time.Second
+	}
+
+	if roundTrip.Timeout.Duration == 0 {
+		roundTrip.Timeout.Duration = min(5*time.Second, roundTrip.Interval.Duration)
+	}
+
+	if len(roundTrip.QoS) == 0 {
+		roundTrip.QoS = []int{0, 1, 2}
+	}
+
+	// A broker that missed three $SYS cycles isn't delivering data
+	if cfg.Readiness.MaxMessageAge.Duration == 0 {
+		cfg.Readiness.MaxMessageAge.Duration = 3 * cfg.Mosquitto.Expiry.SysInterval.Duration
+	}
+
+	if cfg.Mosquitto.Reconnect.InitialBackoff.Duration == 0 {
+		cfg.Mosquitto.Reconnect.InitialBackoff.Duration = time.Second
+	}
+
+	if cfg.Mosquitto.Reconnect.MaxBackoff.Duration == 0 {
+		cfg.Mosquitto.Reconnect.MaxBackoff.Duration = 2 * time.Minute
+	}
+
+	if cfg.Mosquitto.Reconnect.ConnectTimeout.Duration == 0 {
+		cfg.Mosquitto.Reconnect.ConnectTimeout.Duration = 10 * time.Second
 	}
 
 	// Server defaults (maintain backward compatibility with port 9234)
@@ -159,6 +1012,27 @@ func setDefaults(cfg *MosquittoExporterConfig) {
 		cfg.Server.Host = "0.0.0.0"
 	}
 
+	// Additional endpoints listen next to the metrics server by default
+	if cfg.Endpoints.Host == "" {
+		cfg.Endpoints.Host = cfg.Server.Host
+	}
+
+	if cfg.Endpoints.Port == 0 {
+		cfg.Endpoints.Port = 9235
+	}
+
+	// Probe defaults - an unconfigured probe uses a single anonymous module
+	if len(cfg.Probe.Modules) == 0 {
+		cfg.Probe.Modules = map[string]ProbeModule{"default": {}}
+	}
+
+	for name, module := range cfg.Probe.Modules {
+		if module.Timeout.Duration == 0 {
+			module.Timeout.Duration = 10 * time.Second
+			cfg.Probe.Modules[name] = module
+		}
+	}
+
 	// Enable web UI and health endpoint by default
 	if cfg.Server.EnableWebUI == nil {
 		enabled := true
@@ -180,6 +1054,217 @@ func setDefaults(cfg *MosquittoExporterConfig) {
 	}
 }
 
+// validateConfig checks the Mosquitto configuration for mistakes that would
+// otherwise only surface once metrics are registered
+func validateConfig(cfg *MosquittoExporterConfig) error {
+	if cfg.Mosquitto.MetricNaming != NamingLegacy && cfg.Mosquitto.MetricNaming != NamingStructured {
+		return fmt.Errorf("mosquitto.metric_naming must be %q or %q, got %q", NamingLegacy, NamingStructured, cfg.Mosquitto.MetricNaming)
+	}
+
+	if cfg.Mosquitto.Expiry.SysInterval.Duration < 0 {
+		return fmt.Errorf("mosquitto.expiry.sys_interval must be positive")
+	}
+
+	if cfg.Mosquitto.Expiry.Intervals < 0 {
+		return fmt.Errorf("mosquitto.expiry.intervals must not be negative")
+	}
+
+	reconnect := &cfg.Mosquitto.Reconnect
+	if reconnect.InitialBackoff.Duration < 0 || reconnect.MaxBackoff.Duration < reconnect.InitialBackoff.Duration {
+		return fmt.Errorf("mosquitto.reconnect: initial_backoff must be positive and not greater than max_backoff")
+	}
+
+	if reconnect.Jitter < 0 || reconnect.Jitter > 1 {
+		return fmt.Errorf("mosquitto.reconnect.jitter must be between 0 and 1")
+	}
+
+	if reconnect.ConnectTimeout.Duration < 0 {
+		return fmt.Errorf("mosquitto.reconnect.connect_timeout must be positive")
+	}
+
+	if cfg.Readiness.MaxMessageAge.Duration < 0 {
+		return fmt.Errorf("readiness.max_message_age must be positive")
+	}
+
+	for _, class := range cfg.Mosquitto.ErrorPolicy.FatalClasses {
+		if !slices.Contains(errorClasses, class) {
+			return fmt.Errorf("mosquitto.error_policy.fatal_classes: unknown class %q, must be one of %s", class, strings.Join(errorClasses, ", "))
+		}
+	}
+
+	if _, err := newTopicRules(cfg.Mosquitto.TopicMetrics, cfg.Mosquitto.LabelNames()); err != nil {
+		return fmt.Errorf("mosquitto.topic_metrics%w", err)
+	}
+
+	if err := validateTopicGroups(cfg.Mosquitto.TopicGroups); err != nil {
+		return fmt.Errorf("mosquitto.topic_groups%w", err)
+	}
+
+	retained := &cfg.Mosquitto.Retained
+	if retained.Interval.Duration <= 0 || retained.Timeout.Duration <= 0 || retained.Timeout.Duration > retained.Interval.Duration {
+		return fmt.Errorf("mosquitto.retained: interval and timeout must be positive, and timeout not greater than interval")
+	}
+
+	if retained.PrefixDepth < 1 {
+		return fmt.Errorf("mosquitto.retained.prefix_depth must be at least 1")
+	}
+
+	if retained.MaxPrefixes < 2 {
+		return fmt.Errorf("mosquitto.retained.max_prefixes must be at least 2")
+	}
+
+	for i, filter := range retained.Topics {
+		if err := validateTopicFilter(filter); err != nil {
+			return fmt.Errorf("mosquitto.retained.topics[%d]: %w", i, err)
+		}
+	}
+
+	if _, err := parseSelector(retained.TimestampField); err != nil {
+		return fmt.Errorf("mosquitto.retained.timestamp_field: %w", err)
+	}
+
+	for i, bucket := range retained.AgeBuckets {
+		if bucket.Duration <= 0 || (i > 0 && bucket.Duration <= retained.AgeBuckets[i-1].Duration) {
+			return fmt.Errorf("mosquitto.retained.age_buckets must be positive and increasing")
+		}
+	}
+
+	roundTrip := &cfg.Mosquitto.RoundTrip
+	if roundTrip.Interval.Duration <= 0 || roundTrip.Timeout.Duration <= 0 || roundTrip.Timeout.Duration > roundTrip.Interval.Duration {
+		return fmt.Errorf("mosquitto.round_trip: interval and timeout must be positive, and timeout not greater than interval")
+	}
+
+	if err := validateTopicFilter(roundTrip.Topic); err != nil || strings.ContainsAny(roundTrip.Topic, "+#") {
+		return fmt.Errorf("mosquitto.round_trip.topic: %q is not a topic that can be published to", roundTrip.Topic)
+	}
+
+	for i, qos := range roundTrip.QoS {
+		if qos < 0 || qos > 2 || slices.Contains(roundTrip.QoS[:i], qos) {
+			return fmt.Errorf("mosquitto.round_trip.qos must be distinct levels 0, 1 or 2, got %v", roundTrip.QoS)
+		}
+	}
+
+	if cfg.Mosquitto.Traffic.PrefixDepth < 1 {
+		return fmt.Errorf("mosquitto.traffic.prefix_depth must be at least 1")
+	}
+
+	// One prefix besides other
+	if cfg.Mosquitto.Traffic.MaxPrefixes < 2 {
+		return fmt.Errorf("mosquitto.traffic.max_prefixes must be at least 2")
+	}
+
+	for i, filter := range cfg.Mosquitto.Traffic.Topics {
+		if err := validateTopicFilter(filter); err != nil {
+			return fmt.Errorf("mosquitto.traffic.topics[%d]: %w", i, err)
+		}
+	}
+
+	names := make(map[string]bool)
+
+	for i, broker := range cfg.Mosquitto.Brokers {
+		if broker.BrokerEndpoint == "" {
+			return fmt.Errorf("mosquitto.brokers[%d]: broker_endpoint is required", i)
+		}
+
+		if names[broker.Name] {
+			return fmt.Errorf("mosquitto.brokers[%d]: duplicate broker name %q", i, broker.Name)
+		}
+
+		names[broker.Name] = true
+
+		if err := validateEndpoint(broker.BrokerEndpoint); err != nil {
+			return fmt.Errorf("mosquitto.brokers[%d].broker_endpoint: %w", i, err)
+		}
+
+		if broker.Proxy.URL != "" {
+			if err := broker.Proxy.Validate(); err != nil {
+				return fmt.Errorf("mosquitto.brokers[%d].proxy: %w", i, err)
+			}
+
+			if strings.HasPrefix(broker.BrokerEndpoint, "unix://") {
+				return fmt.Errorf("mosquitto.brokers[%d]: proxy cannot be used with a unix:// endpoint", i)
+			}
+		}
+
+		if err := validateProtocol(broker.ProtocolVersion, broker.SessionExpiry.Duration, broker.UserProperties); err != nil {
+			return fmt.Errorf("mosquitto.brokers[%d]: %w", i, err)
+		}
+
+		if broker.SessionExpiry.Duration > 0 && broker.ClientID == "" {
+			return fmt.Errorf("mosquitto.brokers[%d]: session_expiry requires a client_id to resume the session with", i)
+		}
+
+		if broker.TLS.Enabled && strings.HasPrefix(broker.BrokerEndpoint, "unix://") {
+			return fmt.Errorf("mosquitto.brokers[%d]: tls cannot be used with a unix:// endpoint", i)
+		}
+
+		if broker.TLS.Enabled {
+			if err := broker.TLS.Validate(); err != nil {
+				return fmt.Errorf("mosquitto.brokers[%d].tls: %w", i, err)
+			}
+		}
+
+		for name := range broker.Labels {
+			if !labelNamePattern.MatchString(name) {
+				return fmt.Errorf("mosquitto.brokers[%d]: invalid label name %q", i, name)
+			}
+
+			if reservedLabelNames[name] {
+				return fmt.Errorf("mosquitto.brokers[%d]: label name %q is reserved", i, name)
+			}
+		}
+	}
+
+	for name, module := range cfg.Probe.Modules {
+		if err := validateProtocol(module.ProtocolVersion, 0, module.UserProperties); err != nil {
+			return fmt.Errorf("probe.modules.%s: %w", name, err)
+		}
+
+		if module.Proxy.URL != "" {
+			if err := module.Proxy.Validate(); err != nil {
+				return fmt.Errorf("probe.modules.%s.proxy: %w", name, err)
+			}
+		}
+
+		if module.TLS.Enabled {
+			if err := module.TLS.Validate(); err != nil {
+				return fmt.Errorf("probe.modules.%s.tls: %w", name, err)
+			}
+		}
+	}
+
+	// /probe is only served on the endpoints listener
+	if cfg.Probe.Enabled && !cfg.Endpoints.Enabled {
+		return fmt.Errorf("probe.enabled requires endpoints.enabled")
+	}
+
+	if cfg.Endpoints.Enabled && cfg.Endpoints.Port == cfg.Server.Port {
+		return fmt.Errorf("endpoints.port must differ from server.port (%d)", cfg.Server.Port)
+	}
+
+	return nil
+}
+
+// validateProtocol checks the MQTT protocol version and the settings that
+// require MQTT v5
+func validateProtocol(version int, sessionExpiry time.Duration, userProperties map[string]string) error {
+	switch version {
+	case 0, 3, 4, 5:
+	default:
+		return fmt.Errorf("protocol_version must be 3 (MQTT 3.1), 4 (MQTT 3.1.1) or 5, got %d", version)
+	}
+
+	if version != 5 && (sessionExpiry != 0 || len(userProperties) > 0) {
+		return fmt.Errorf("session_expiry and user_properties require protocol_version 5")
+	}
+
+	if sessionExpiry < 0 || sessionExpiry > math.MaxUint32*time.Second {
+		return fmt.Errorf("session_expiry must be between 0 and %s", time.Duration(math.MaxUint32)*time.Second)
+	}
+
+	return nil
+}
+
 // getEnv gets environment variable with fallback to legacy name
 func getEnv(newName, legacyName string) string {
 	if val := os.Getenv(newName); val != "" {
@@ -189,6 +1274,51 @@ func getEnv(newName, legacyName string) string {
 	return os.Getenv(legacyName)
 }
 
+// splitList splits a comma-separated environment variable value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// parseHeaders parses a comma-separated list of Name=value HTTP headers
+func parseHeaders(value string) (map[string]Secret, error) {
+	items, err := parseKeyValues(value)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]Secret, len(items))
+	for name, headerValue := range items {
+		headers[name] = NewSecret(headerValue)
+	}
+
+	return headers, nil
+}
+
+// parseKeyValues parses a comma-separated list of key=value pairs
+func parseKeyValues(value string) (map[string]string, error) {
+	items := make(map[string]string)
+
+	for i, item := range splitList(value) {
+		// The value isn't included in errors as it may carry credentials
+		key, itemValue, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("item %d must be in the form key=value", i+1)
+		}
+
+		items[strings.TrimSpace(key)] = strings.TrimSpace(itemValue)
+	}
+
+	return items, nil
+}
+
 // parseBindAddress parses bind address in format "host:port"
 func parseBindAddress(bindAddress string) (string, int) {
 	// Simple parsing - find last colon
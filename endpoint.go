@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/proxy"
+)
+
+// Broker endpoint schemes understood by the MQTT client, by transport
+var (
+	tcpSchemes       = []string{"tcp", "mqtt"}
+	tlsSchemes       = []string{"ssl", "tls", "mqtts", "mqtt+ssl", "tcps"}
+	webSocketSchemes = []string{"ws", "wss"}
+)
+
+// parseEndpoint parses a broker endpoint. Like the MQTT client, an endpoint
+// without a scheme is taken to be tcp://.
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "tcp://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+
+	return u, nil
+}
+
+// validateEndpoint returns an error explaining why the exporter can't
+// connect to endpoint
+func validateEndpoint(endpoint string) error {
+	u, err := parseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case slices.Contains(tcpSchemes, u.Scheme), slices.Contains(tlsSchemes, u.Scheme), slices.Contains(webSocketSchemes, u.Scheme):
+	case u.Scheme == "unix":
+		if unixSocketPath(u) == "" {
+			return fmt.Errorf("endpoint %q has no socket path", endpoint)
+		}
+
+		return nil
+	case u.Scheme == "http" || u.Scheme == "https":
+		return fmt.Errorf("unsupported scheme %q in %q: MQTT over WebSockets uses ws:// or wss://", u.Scheme, endpoint)
+	default:
+		return fmt.Errorf("unsupported scheme %q in %q: use tcp:// or mqtt:// for MQTT, ssl://, tls:// or mqtts:// for MQTT over TLS, ws:// or wss:// for MQTT over WebSockets, or unix:// for a unix domain socket", u.Scheme, endpoint)
+	}
+
+	if u.Hostname() == "" {
+		return fmt.Errorf("endpoint %q has no host", endpoint)
+	}
+
+	if isWebSocketEndpoint(u) {
+		return nil
+	}
+
+	if u.Port() == "" {
+		return fmt.Errorf("endpoint %q has no port", endpoint)
+	}
+
+	if u.Path != "" && u.Path != "/" {
+		return fmt.Errorf("endpoint %q has a path, which is only used by ws:// and wss:// endpoints", endpoint)
+	}
+
+	return nil
+}
+
+// isWebSocketEndpoint returns true if u connects to the broker over WebSockets
+func isWebSocketEndpoint(u *url.URL) bool {
+	return slices.Contains(webSocketSchemes, u.Scheme)
+}
+
+// isTLSEndpoint returns true if u connects to the broker over TLS
+func isTLSEndpoint(u *url.URL) bool {
+	return slices.Contains(tlsSchemes, u.Scheme) || u.Scheme == "wss"
+}
+
+// unixSocketPath returns the socket path of a unix:// endpoint. Both
+// unix:///run/mosquitto.sock and the relative unix://mosquitto.sock are accepted.
+func unixSocketPath(u *url.URL) string {
+	return u.Host + u.Path
+}
+
+// openUnixConnection connects to a broker listening on a unix domain socket,
+// see mqtt.OpenConnectionFunc
+func openUnixConnection(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: options.ConnectTimeout}
+
+	return dialer.Dial("unix", unixSocketPath(uri))
+}
+
+// openDirectConnection connects to a broker directly, or through a proxy
+// from the environment, like the MQTT v3 client does on its own. It is used
+// by the MQTT v5 client, which leaves dialing to the caller.
+func openDirectConnection(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+	switch {
+	case uri.Scheme == "unix":
+		return openUnixConnection(uri, options)
+	case isWebSocketEndpoint(uri):
+		return openWebSocket(uri, options)
+	}
+
+	ctx, cancel := connectContext(options)
+	defer cancel()
+
+	conn, err := proxy.Dial(ctx, "tcp", uri.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(tlsSchemes, uri.Scheme) {
+		return conn, nil
+	}
+
+	return startTLS(ctx, conn, uri, options)
+}
+
+// openWebSocket connects to a ws:// or wss:// endpoint, using the proxy
+// from the WebSocket options or else the environment
+func openWebSocket(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+	var tlsConfig *tls.Config
+	if uri.Scheme == "wss" {
+		tlsConfig = options.TLSConfig
+	}
+
+	// The WebSocket dialer rejects URLs with credentials
+	dialURI := *uri
+	dialURI.User = nil
+
+	return mqtt.NewWebsocket(dialURI.String(), tlsConfig, options.ConnectTimeout, options.HTTPHeaders, options.WebsocketOptions)
+}
+
+// startTLS performs the TLS handshake with the broker over conn, closing conn if it fails
+func startTLS(ctx context.Context, conn net.Conn, uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+	tlsConfig := &tls.Config{} //nolint:gosec // MinVersion is left to the configured TLS settings
+	if options.TLSConfig != nil {
+		tlsConfig = options.TLSConfig.Clone()
+	}
+
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = uri.Hostname()
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// connectContext returns a context bounded by the connect timeout, if any
+func connectContext(options mqtt.ClientOptions) (context.Context, context.CancelFunc) {
+	if options.ConnectTimeout > 0 {
+		return context.WithTimeout(context.Background(), options.ConnectTimeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// EndpointURL returns the URL the MQTT client connects to, with the
+// WebSocket path applied to ws:// and wss:// endpoints that don't have one
+func (b *BrokerConfig) EndpointURL() (*url.URL, error) {
+	u, err := parseEndpoint(b.BrokerEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if isWebSocketEndpoint(u) && (u.Path == "" || u.Path == "/") && b.WebSocket.Path != "" {
+		u.Path = "/" + strings.TrimPrefix(b.WebSocket.Path, "/")
+	}
+
+	return u, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// EndpointServer serves the exporter's additional HTTP endpoints. The
+// promexporter server doesn't allow registering extra routes, so these are
+// served on their own listener. It implements the app.Collector interface so
+// its lifecycle follows the application's.
+type EndpointServer struct {
+	address string
+	mux     *http.ServeMux
+	server  *http.Server
+}
+
+// NewEndpointServer creates a new endpoint server listening on the configured address
+func NewEndpointServer(cfg *EndpointsConfig) *EndpointServer {
+	return &EndpointServer{
+		address: fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
+		mux:     http.NewServeMux(),
+	}
+}
+
+// Handle registers the handler for the given pattern
+func (es *EndpointServer) Handle(pattern string, handler http.Handler) {
+	es.mux.Handle(pattern, handler)
+}
+
+// Start implements the Collector interface - starts serving in a goroutine
+func (es *EndpointServer) Start(ctx context.Context) {
+	es.server = &http.Server{
+		Addr:              es.address,
+		Handler:           es.mux,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	slog.Info("Starting endpoint server", "address", es.address)
+
+	go func() {
+		if err := es.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Endpoint server failed", "address", es.address, "error", err)
+		}
+	}()
+}
+
+// Stop implements the Collector interface - gracefully shuts down the server
+func (es *EndpointServer) Stop() {
+	if es.server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := es.server.Shutdown(ctx); err != nil {
+		slog.Error("Endpoint server shutdown error", "error", err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Connection error classes, used as the "class" label of connection failure
+// metrics and by the error policy
+const (
+	errorClassAuth     = "auth"
+	errorClassRejected = "rejected"
+	errorClassTLS      = "tls"
+	errorClassDNS      = "dns"
+	errorClassRefused  = "refused"
+	errorClassTimeout  = "timeout"
+	errorClassOther    = "other"
+)
+
+// classifyError returns the class of an error returned while connecting to a broker
+func classifyError(err error) string {
+	var (
+		tlsSetupErr  *tlsSetupError
+		connackErr   *connackError
+		dnsErr       *net.DNSError
+		netErr       net.Error
+		certVerifErr *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		unknownCA    x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		certInvalid  x509.CertificateInvalidError
+	)
+
+	switch {
+	case errors.As(err, &connackErr):
+		return connackErr.Class()
+	case errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword),
+		errors.Is(err, packets.ErrorRefusedNotAuthorised):
+		return errorClassAuth
+	case errors.Is(err, packets.ErrorRefusedBadProtocolVersion),
+		errors.Is(err, packets.ErrorRefusedIDRejected):
+		return errorClassRejected
+	case errors.As(err, &tlsSetupErr), errors.As(err, &certVerifErr), errors.As(err, &recordErr), errors.As(err, &alertErr),
+		errors.As(err, &unknownCA), errors.As(err, &hostnameErr), errors.As(err, &certInvalid):
+		return errorClassTLS
+	case errors.As(err, &dnsErr):
+		return errorClassDNS
+	case errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, packets.ErrorRefusedServerUnavailable), // the broker can't take connections right now
+		errors.Is(err, syscall.ENOENT):                        // unix socket that doesn't exist (yet)
+		return errorClassRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return errorClassTimeout
+	default:
+		return errorClassOther
+	}
+}
+
+// errorClasses lists every class classifyError returns
+var errorClasses = []string{
+	errorClassAuth, errorClassRejected, errorClassTLS, errorClassDNS,
+	errorClassRefused, errorClassTimeout, errorClassOther,
+}
+
+// tlsSetupError is a failure to load the TLS settings of a broker connection,
+// such as an unreadable certificate, which is classified like a failed handshake
+type tlsSetupError struct {
+	err error
+}
+
+func (e *tlsSetupError) Error() string {
+	return "configure TLS: " + e.err.Error()
+}
+
+func (e *tlsSetupError) Unwrap() error {
+	return e.err
+}
+
+// connackError is an MQTT v5 CONNACK whose reason code refused the connection
+type connackError struct {
+	code   byte
+	reason string // reason string sent by the broker, if any
+}
+
+func (e *connackError) Error() string {
+	msg := fmt.Sprintf("connection refused: %s (reason code 0x%02X)", connackReason(e.code), e.code)
+	if e.reason != "" {
+		msg += ": " + e.reason
+	}
+
+	return msg
+}
+
+// Class returns the error class of the reason code
+func (e *connackError) Class() string {
+	switch e.code {
+	case 0x86, 0x87, 0x8C: // bad user name or password, not authorized, bad authentication method
+		return errorClassAuth
+	case 0x84, 0x85, 0x8A, 0x95: // unsupported protocol version, client identifier not valid, banned, packet too large
+		return errorClassRejected
+	case 0x88, 0x89, 0x97, 0x9C, 0x9D, 0x9F: // server unavailable or busy, quota or rate exceeded, use another server
+		return errorClassRefused
+	default:
+		return errorClassOther
+	}
+}
+
+// disconnectError is an MQTT v5 DISCONNECT sent by the broker to close the connection
+type disconnectError struct {
+	code   byte
+	reason string // reason string sent by the broker, if any
+}
+
+func (e *disconnectError) Error() string {
+	msg := fmt.Sprintf("disconnected by broker: %s (reason code 0x%02X)", disconnectReason(e.code), e.code)
+	if e.reason != "" {
+		msg += ": " + e.reason
+	}
+
+	return msg
+}
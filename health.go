@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HealthHandler serves the connection state of every broker, including the
+// class of the last connection error. It responds with 503 while a broker is
+// disconnected because of an error the error policy considers fatal, as
+// retrying won't fix it.
+type HealthHandler struct {
+	statuses func() []brokerStatus
+}
+
+// NewHealthHandler creates a handler reporting the given broker statuses
+func NewHealthHandler(statuses func() []brokerStatus) *HealthHandler {
+	return &HealthHandler{statuses: statuses}
+}
+
+// ServeHTTP implements http.Handler
+func (hh *HealthHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	brokers := hh.statuses()
+
+	status, code := "healthy", http.StatusOK
+
+	for _, broker := range brokers {
+		if !broker.Connected && broker.LastError != nil && broker.LastError.Fatal {
+			status, code = "unhealthy", http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+
+	_ = json.NewEncoder(w).Encode(struct {
+		Status    string         `json:"status"`
+		Timestamp int64          `json:"timestamp"`
+		Brokers   []brokerStatus `json:"brokers"`
+	}{status, time.Now().Unix(), brokers})
+}
+
+// ReadyHandler reports whether the exporter is seeing data from every broker:
+// it must be connected, subscribed to $SYS/# and have received a $SYS message
+// within the maximum message age. Otherwise it responds with 503 and the
+// checks that failed, so that Kubernetes stops routing to an exporter that
+// has nothing to export.
+type ReadyHandler struct {
+	statuses      func() []brokerStatus
+	maxMessageAge time.Duration
+}
+
+// readinessCheck is the result of one readiness check of a broker
+type readinessCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// brokerReadiness is the readiness of a broker as reported by /ready
+type brokerReadiness struct {
+	Name   string           `json:"name"`
+	Ready  bool             `json:"ready"`
+	Checks []readinessCheck `json:"checks"`
+}
+
+// NewReadyHandler creates a handler checking the given broker statuses
+func NewReadyHandler(statuses func() []brokerStatus, maxMessageAge time.Duration) *ReadyHandler {
+	return &ReadyHandler{statuses: statuses, maxMessageAge: maxMessageAge}
+}
+
+// ServeHTTP implements http.Handler
+func (rh *ReadyHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+
+	status, code := "ready", http.StatusOK
+	brokers := make([]brokerReadiness, 0)
+
+	for _, broker := range rh.statuses() {
+		readiness := rh.check(broker, now)
+		if !readiness.Ready {
+			status, code = "not ready", http.StatusServiceUnavailable
+		}
+
+		brokers = append(brokers, readiness)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+
+	_ = json.NewEncoder(w).Encode(struct {
+		Status    string            `json:"status"`
+		Timestamp int64             `json:"timestamp"`
+		Brokers   []brokerReadiness `json:"brokers"`
+	}{status, now.Unix(), brokers})
+}
+
+// check runs the readiness checks of a broker
+func (rh *ReadyHandler) check(broker brokerStatus, now time.Time) brokerReadiness {
+	connected := readinessCheck{Name: "connected", OK: broker.Connected}
+	if !connected.OK {
+		connected.Reason = "not connected to the broker"
+		if broker.LastError != nil {
+			connected.Reason += ": " + broker.LastError.Message
+		}
+	}
+
+	subscribed := readinessCheck{Name: "subscribed", OK: broker.Subscribed}
+	if !subscribed.OK {
+		subscribed.Reason = "no active $SYS/# subscription"
+	}
+
+	fresh := readinessCheck{Name: "fresh", OK: true}
+
+	switch {
+	case broker.LastMessage == nil:
+		fresh.OK = false
+		fresh.Reason = "no $SYS message received yet"
+	case now.Sub(*broker.LastMessage) > rh.maxMessageAge:
+		fresh.OK = false
+		fresh.Reason = fmt.Sprintf("last $SYS message received %s ago, more than the maximum of %s",
+			now.Sub(*broker.LastMessage).Round(time.Second), rh.maxMessageAge)
+	}
+
+	return brokerReadiness{
+		Name:   broker.Name,
+		Ready:  connected.OK && subscribed.OK && fresh.OK,
+		Checks: []readinessCheck{connected, subscribed, fresh},
+	}
+}
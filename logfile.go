@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// logFilePollInterval is how often the log file is checked for new lines,
+// rotation and truncation
+const logFilePollInterval = time.Second
+
+// logTailer follows a Mosquitto log file and passes every complete line to
+// handle. It starts at the end of the file, follows the file to its new
+// inode when it is rotated and starts over when it is truncated.
+//
+// Mosquitto writes lines as "<timestamp>: <message>", where the timestamp is
+// a Unix time, a log_timestamp_format formatted time, or absent if
+// log_timestamp is disabled. The log patterns are unanchored, so lines are
+// passed on unmodified.
+type logTailer struct {
+	path   string
+	handle func(line string)
+
+	file    *os.File
+	reader  *bufio.Reader
+	offset  int64
+	partial string
+	opened  bool
+	failing bool
+}
+
+// newLogTailer creates a tailer for the file at path
+func newLogTailer(path string, handle func(line string)) *logTailer {
+	return &logTailer{
+		path:   path,
+		handle: handle,
+	}
+}
+
+// Run follows the file until ctx is cancelled
+func (lt *logTailer) Run(ctx context.Context) {
+	slog.Info("Tailing Mosquitto log file", "path", lt.path)
+
+	ticker := time.NewTicker(logFilePollInterval)
+	defer ticker.Stop()
+
+	defer lt.close()
+
+	for {
+		lt.poll()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll reads any new lines, reopening the file if it was rotated
+func (lt *logTailer) poll() {
+	if lt.file == nil {
+		if err := lt.open(); err != nil {
+			lt.fail("Failed to open Mosquitto log file", err)
+			return
+		}
+	}
+
+	lt.readLines()
+
+	current, err := os.Stat(lt.path)
+	if err != nil {
+		// The file may be mid-rotation; keep reading the old one until it reappears
+		return
+	}
+
+	opened, err := lt.file.Stat()
+	if err != nil {
+		lt.fail("Failed to stat Mosquitto log file", err)
+		lt.close()
+
+		return
+	}
+
+	switch {
+	case !os.SameFile(current, opened):
+		// Rotated: the old file has been drained above, continue with the new one
+		slog.Info("Mosquitto log file rotated", "path", lt.path)
+		lt.close()
+
+		if err := lt.open(); err != nil {
+			lt.fail("Failed to open Mosquitto log file", err)
+			return
+		}
+
+		lt.readLines()
+	case opened.Size() < lt.offset:
+		slog.Info("Mosquitto log file truncated", "path", lt.path)
+
+		if _, err := lt.file.Seek(0, io.SeekStart); err != nil {
+			lt.fail("Failed to rewind Mosquitto log file", err)
+			lt.close()
+
+			return
+		}
+
+		lt.offset = 0
+		lt.partial = ""
+		lt.reader.Reset(lt.file)
+		lt.readLines()
+	}
+}
+
+// open opens the file. The first time it starts at the end of the file so
+// history isn't counted; after rotation it starts at the beginning.
+func (lt *logTailer) open() error {
+	file, err := os.Open(lt.path)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+
+	if !lt.opened {
+		offset, err = file.Seek(0, io.SeekEnd)
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+
+	if lt.failing {
+		slog.Info("Mosquitto log file available again", "path", lt.path)
+	}
+
+	lt.file = file
+	lt.reader = bufio.NewReader(file)
+	lt.offset = offset
+	lt.partial = ""
+	lt.opened = true
+	lt.failing = false
+
+	return nil
+}
+
+// readLines passes every complete line appended since the last read to handle
+func (lt *logTailer) readLines() {
+	for {
+		chunk, err := lt.reader.ReadString('\n')
+		lt.offset += int64(len(chunk))
+
+		if err != nil {
+			// Keep an incomplete last line until the rest of it is written
+			lt.partial += chunk
+
+			if !errors.Is(err, io.EOF) {
+				lt.fail("Failed to read Mosquitto log file", err)
+			}
+
+			return
+		}
+
+		line := lt.partial + chunk[:len(chunk)-1]
+		lt.partial = ""
+
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+
+		lt.handle(line)
+	}
+}
+
+// close closes the file, if open
+func (lt *logTailer) close() {
+	if lt.file != nil {
+		_ = lt.file.Close()
+		lt.file = nil
+	}
+}
+
+// fail logs an error once until the file can be read again
+func (lt *logTailer) fail(msg string, err error) {
+	if !lt.failing {
+		slog.Warn(msg, "path", lt.path, "error", err)
+	}
+
+	lt.failing = true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxAuthFailureAddresses bounds the number of distinct address label values
+// on a broker's authentication failure counter; further addresses are
+// reported as "other"
+const maxAuthFailureAddresses = 100
+
+// logTopicPrefix is the $SYS subtree Mosquitto publishes log lines under when
+// configured with "log_dest topic"
+const logTopicPrefix = "$SYS/broker/log/"
+
+// logSeverities maps the log topic suffix to a severity label
+var logSeverities = map[string]string{
+	"E":             "error",
+	"W":             "warning",
+	"N":             "notice",
+	"I":             "information",
+	"D":             "debug",
+	"S":             "subscribe",
+	"U":             "unsubscribe",
+	"M/subscribe":   "subscribe",
+	"M/unsubscribe": "unsubscribe",
+}
+
+// logSeverityForTopic returns the severity of a log topic
+func logSeverityForTopic(topic string) (string, bool) {
+	suffix, ok := strings.CutPrefix(topic, logTopicPrefix)
+	if !ok || suffix == "" {
+		return "", false
+	}
+
+	if severity, ok := logSeverities[suffix]; ok {
+		return severity, true
+	}
+
+	return strings.ToLower(suffix), true
+}
+
+// Log line patterns. They are unanchored so they match regardless of the
+// timestamp prefix Mosquitto adds to the line.
+var (
+	logConnectPattern       = regexp.MustCompile(`New client connected from \S+ as (\S+) \([^)]*\)`)
+	logAuthFailurePattern   = regexp.MustCompile(`Client (\S+)(?: \[([^\]]*)\])? disconnected,? (?:not authori[sz]ed|bad username or password)`)
+	logTakeoverPattern      = regexp.MustCompile(`Client (\S+)(?: \[[^\]]*\])? already connected, closing old connection`)
+	logSocketErrorPattern   = regexp.MustCompile(`Socket error on client (\S+), disconnecting`)
+	logTimeoutPattern       = regexp.MustCompile(`Client (\S+)(?: \[[^\]]*\])? has exceeded timeout, disconnecting`)
+	logProtocolErrorPattern = regexp.MustCompile(`Client (\S+)(?: \[[^\]]*\])? disconnected due to (?:a )?(?:protocol|malformed packet) error`)
+	logClosedPattern        = regexp.MustCompile(`Client (\S+)(?: \[[^\]]*\])? closed its connection`)
+	logDisconnectPattern    = regexp.MustCompile(`Client (\S+)(?: \[[^\]]*\])? disconnected\.`)
+)
+
+// logDisconnectPatterns maps disconnection log lines to their reason, most specific first
+var logDisconnectPatterns = []struct {
+	pattern *regexp.Regexp
+	reason  string
+}{
+	{logSocketErrorPattern, disconnectReasonSocketError},
+	{logTimeoutPattern, disconnectReasonTimeout},
+	{logProtocolErrorPattern, disconnectReasonProtocolError},
+	{logClosedPattern, disconnectReasonClosed},
+	{logDisconnectPattern, disconnectReasonClient},
+}
+
+// logEventKind identifies the kind of client activity a log line reports
+type logEventKind int
+
+const (
+	logEventNone logEventKind = iota
+	logEventConnect
+	logEventDisconnect
+	logEventAuthFailure
+	logEventTakeover
+)
+
+// Disconnection reasons
+const (
+	disconnectReasonClient        = "client"
+	disconnectReasonClosed        = "closed"
+	disconnectReasonTimeout       = "timeout"
+	disconnectReasonProtocolError = "protocol_error"
+	disconnectReasonSocketError   = "socket_error"
+	disconnectReasonNotAuthorised = "not_authorised"
+)
+
+// logEvent is the client activity reported by a single log line
+type logEvent struct {
+	kind     logEventKind
+	clientID string
+	reason   string
+
+	// address is the client's host, if the line has it
+	address string
+}
+
+// parseLogLine returns the client activity reported by a Mosquitto log line, if any
+func parseLogLine(line string) logEvent {
+	if m := logConnectPattern.FindStringSubmatch(line); m != nil {
+		return logEvent{kind: logEventConnect, clientID: m[1]}
+	}
+
+	// Mosquitto doesn't log the username a client failed to authenticate
+	// with, and only newer versions log its address
+	if m := logAuthFailurePattern.FindStringSubmatch(line); m != nil {
+		return logEvent{kind: logEventAuthFailure, clientID: m[1], reason: disconnectReasonNotAuthorised, address: logAddressHost(m[2])}
+	}
+
+	if m := logTakeoverPattern.FindStringSubmatch(line); m != nil {
+		return logEvent{kind: logEventTakeover, clientID: m[1]}
+	}
+
+	for _, d := range logDisconnectPatterns {
+		if m := d.pattern.FindStringSubmatch(line); m != nil {
+			return logEvent{kind: logEventDisconnect, clientID: m[1], reason: d.reason}
+		}
+	}
+
+	return logEvent{kind: logEventNone}
+}
+
+// logAddressHost returns the host of a logged host:port address. IPv6
+// addresses aren't bracketed in the log, so the port is cut at the last colon.
+func logAddressHost(address string) string {
+	i := strings.LastIndexByte(address, ':')
+	if i < 0 {
+		return address
+	}
+
+	if _, err := strconv.ParseUint(address[i+1:], 10, 16); err != nil {
+		return address
+	}
+
+	return address[:i]
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want logEvent
+	}{
+		{
+			"1700000000: New client connected from 10.0.0.1:51234 as sensor-1 (p2, c1, k60, u'alice').",
+			logEvent{kind: logEventConnect, clientID: "sensor-1"},
+		},
+		{
+			"1700000000: Client sensor-1 [10.0.0.1:51234] disconnected, not authorised.",
+			logEvent{kind: logEventAuthFailure, clientID: "sensor-1", reason: disconnectReasonNotAuthorised, address: "10.0.0.1"},
+		},
+		{
+			"1700000000: Client sensor-1 [2001:db8::1:51234] disconnected, not authorised.",
+			logEvent{kind: logEventAuthFailure, clientID: "sensor-1", reason: disconnectReasonNotAuthorised, address: "2001:db8::1"},
+		},
+		{
+			"1700000000: Client sensor-1 disconnected, not authorised.",
+			logEvent{kind: logEventAuthFailure, clientID: "sensor-1", reason: disconnectReasonNotAuthorised},
+		},
+		{
+			"1700000000: Client sensor-1 [10.0.0.1:51234] already connected, closing old connection.",
+			logEvent{kind: logEventTakeover, clientID: "sensor-1"},
+		},
+		{
+			"1700000000: Client sensor-1 has exceeded timeout, disconnecting.",
+			logEvent{kind: logEventDisconnect, clientID: "sensor-1", reason: disconnectReasonTimeout},
+		},
+		{
+			"1700000000: Client sensor-1 disconnected.",
+			logEvent{kind: logEventDisconnect, clientID: "sensor-1", reason: disconnectReasonClient},
+		},
+		{
+			"1700000000: mosquitto version 2.0.18 running",
+			logEvent{kind: logEventNone},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := parseLogLine(tt.line); got != tt.want {
+			t.Errorf("parseLogLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestAuthFailureAddressLimit(t *testing.T) {
+	mm := NewProbeMetrics(prometheus.NewRegistry(), NamingLegacy)
+
+	for i := range maxAuthFailureAddresses {
+		address := fmt.Sprintf("10.0.0.%d", i)
+		if got := mm.authFailureAddress([]string{"a"}, address); got != address {
+			t.Fatalf("address %d reported as %q", i, got)
+		}
+	}
+
+	if got := mm.authFailureAddress([]string{"a"}, "10.0.1.1"); got != "other" {
+		t.Errorf("address over the limit reported as %q, want other", got)
+	}
+
+	if got := mm.authFailureAddress([]string{"a"}, "10.0.0.1"); got != "10.0.0.1" {
+		t.Errorf("known address reported as %q", got)
+	}
+
+	if got := mm.authFailureAddress([]string{"b"}, "10.0.1.1"); got != "10.0.1.1" {
+		t.Errorf("address of another broker reported as %q", got)
+	}
+
+	if got := mm.authFailureAddress([]string{"a"}, ""); got != "unknown" {
+		t.Errorf("missing address reported as %q, want unknown", got)
+	}
+}
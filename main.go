@@ -60,14 +60,22 @@ func main() {
 		Format: cfg.Logging.Format,
 	})
 
+	brokerEndpoints := make([]string, 0, len(cfg.Mosquitto.Brokers))
+	for _, broker := range cfg.Mosquitto.Brokers {
+		brokerEndpoints = append(brokerEndpoints, broker.BrokerEndpoint)
+	}
+
 	slog.Info("Starting Mosquitto Exporter",
 		"version", versionString(),
-		"broker", cfg.Mosquitto.BrokerEndpoint,
+		"brokers", brokerEndpoints,
 		"bind_address", fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
 	)
 
 	// Initialize metrics registry
-	metricsRegistry := NewMosquittoMetrics()
+	metricsRegistry := NewMosquittoMetrics(cfg.Mosquitto.LabelNames(), cfg.Mosquitto.MetricNaming)
+	if cfg.Mosquitto.Retained.Enabled {
+		metricsRegistry.EnableRetainedCensus()
+	}
 
 	// Build application
 	application := app.New(appName).
@@ -79,9 +87,31 @@ func main() {
 	collector := NewMosquittoCollector(cfg, metricsRegistry, application)
 	application.WithCollector(collector)
 
+	// Additional endpoints are served on their own listener, if enabled
+	if cfg.Endpoints.Enabled {
+		endpoints := NewEndpointServer(&cfg.Endpoints)
+		endpoints.Handle("/health", NewHealthHandler(collector.Statuses))
+		endpoints.Handle("/ready", NewReadyHandler(collector.Statuses, cfg.Readiness.MaxMessageAge.Duration))
+
+		if cfg.Mosquitto.Retained.Enabled {
+			endpoints.Handle("/retained", NewRetainedHandler(collector.RetainedInventories))
+		}
+
+		if cfg.Probe.Enabled {
+			endpoints.Handle("/probe", NewProbeHandler(&cfg.Probe, cfg.Mosquitto.MetricNaming))
+		}
+
+		application.WithCollector(endpoints)
+	}
+
 	// Build and run the application
 	if err := application.Build().Run(); err != nil {
 		slog.Error("Application failed", "error", err)
 		os.Exit(1)
 	}
+
+	if err := collector.Err(); err != nil {
+		slog.Error("Exiting after fatal error", "error", err)
+		os.Exit(1)
+	}
 }
@@ -1,8 +1,13 @@
 package main
 
 import (
-	"strings"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/d0ugal/promexporter/metrics"
 	"github.com/prometheus/client_golang/prometheus"
@@ -34,52 +39,324 @@ var (
 	}
 )
 
-// MosquittoMetrics manages all Prometheus metrics for the Mosquitto exporter
+// lastUpdateMetricName is the store family recording when each topic was last updated
+const (
+	lastUpdateMetricName = "mosquitto_metric_last_update_timestamp_seconds"
+	lastUpdateMetricHelp = "Unix timestamp of the last value received on each $SYS topic"
+)
+
+// MosquittoMetrics manages all Prometheus metrics for the Mosquitto exporter.
+// Every broker-derived metric carries the labels in labelNames, the first of
+// which is always "broker".
 type MosquittoMetrics struct {
 	registry             *metrics.Registry
-	counterMetrics       map[string]*MosquittoCounter
-	gaugeMetrics         map[string]prometheus.Gauge
-	brokerConnectionUp   prometheus.Gauge
-	lastMessageTimestamp prometheus.Gauge
+	registerer           prometheus.Registerer
+	labelNames           []string
+	naming               string
+	store                *metricStore
+	traffic              *trafficCollector
+	retained             *retainedCollector
+	roundTrip            *roundTripCollector
+	brokerConnectionUp   *prometheus.GaugeVec
+	lastMessageTimestamp *prometheus.GaugeVec
 	brokerInfo           *prometheus.GaugeVec
+	brokerRestarts       *prometheus.CounterVec
+	brokerStartTime      *prometheus.GaugeVec
+	logMessages          *prometheus.CounterVec
+	logConnections       *prometheus.CounterVec
+	logDisconnections    *prometheus.CounterVec
+	logAuthFailures      *prometheus.CounterVec
+	logTakeovers         *prometheus.CounterVec
+	connectAttempts      *prometheus.CounterVec
+	connectFailures      *prometheus.CounterVec
+	connectDuration      *prometheus.HistogramVec
+	connectBackoff       *prometheus.GaugeVec
+	connectFailureStreak *prometheus.GaugeVec
+	lastConnectError     *prometheus.GaugeVec
+	connackReasons       *prometheus.CounterVec
+	disconnectReasons    *prometheus.CounterVec
+	sessionExpiry        *prometheus.GaugeVec
+	subscribeFailures    *prometheus.CounterVec
+	messagesReceived     *prometheus.CounterVec
+	unparseablePayloads  *prometheus.CounterVec
+	ignoredTopics        *prometheus.CounterVec
+	handlerDuration      *prometheus.HistogramVec
+	topicMetricErrors    *prometheus.CounterVec
+	topicGroupSizes      *prometheus.HistogramVec
+	topicGroupGaps       *prometheus.HistogramVec
+	topicGroupMessages   *prometheus.CounterVec
+	censusTimestamp      *prometheus.GaugeVec
+	censusDuration       *prometheus.GaugeVec
+	censusComplete       *prometheus.GaugeVec
+	censusFailures       *prometheus.CounterVec
+	roundTripLatency     *prometheus.HistogramVec
+	roundTripProbes      *prometheus.CounterVec
+	roundTripConnected   *prometheus.GaugeVec
+	tlsCertNotAfter      *prometheus.GaugeVec
+	tlsReloadSuccess     *prometheus.GaugeVec
+	tlsReloadTimestamp   *prometheus.GaugeVec
+	tlsServerNotAfter    *prometheus.GaugeVec
+	tlsServerCertInfo    *prometheus.GaugeVec
+	tlsServerChainLength *prometheus.GaugeVec
+	tlsServerVerified    *prometheus.GaugeVec
+	tlsServerVerifyError *prometheus.GaugeVec
+	tlsConnectionInfo    *prometheus.GaugeVec
+	startTimes           map[string]time.Time
+	authFailureAddresses map[string]map[string]bool
 	mu                   sync.RWMutex
 }
 
-// NewMosquittoMetrics creates a new metrics registry
-func NewMosquittoMetrics() *MosquittoMetrics {
+// NewMosquittoMetrics creates a new metrics registry using the given broker
+// label names and metric naming mode
+func NewMosquittoMetrics(labelNames []string, naming string) *MosquittoMetrics {
 	registry := metrics.NewRegistry("mosquitto_exporter_info")
 
+	return newMosquittoMetrics(registry, registry.GetRegistry(), labelNames, naming)
+}
+
+// NewProbeMetrics creates metrics backed by the given plain registry, without
+// the exporter's own runtime and info metrics. It is used for one-shot probes.
+func NewProbeMetrics(registerer prometheus.Registerer, naming string) *MosquittoMetrics {
+	return newMosquittoMetrics(nil, registerer, []string{"broker"}, naming)
+}
+
+// newMosquittoMetrics registers the broker metrics with registerer. registry
+// is only used to describe metrics in the web UI and may be nil.
+func newMosquittoMetrics(registry *metrics.Registry, registerer prometheus.Registerer, labelNames []string, naming string) *MosquittoMetrics {
+	mm := &MosquittoMetrics{
+		registry:             registry,
+		registerer:           registerer,
+		labelNames:           labelNames,
+		naming:               naming,
+		startTimes:           make(map[string]time.Time),
+		authFailureAddresses: make(map[string]map[string]bool),
+	}
+
+	// Topic-derived metrics are held in a store that is collected at scrape time
+	mm.store = newMetricStore(mm.addMetricInfo)
+	registerer.MustRegister(mm.store)
+
+	// Traffic accounts are also read at scrape time
+	mm.traffic = newTrafficCollector(labelNames)
+	registerer.MustRegister(mm.traffic)
+
+	for _, name := range []string{topicMessagesMetricName, topicBytesMetricName, topicPrefixesMetricName} {
+		mm.store.Reserve(name)
+	}
+
+	mm.addMetricInfo(topicMessagesMetricName, topicMessagesMetricHelp, append(append([]string{}, labelNames...), "prefix"))
+	mm.addMetricInfo(topicBytesMetricName, topicBytesMetricHelp, append(append([]string{}, labelNames...), "prefix"))
+	mm.addMetricInfo(topicPrefixesMetricName, topicPrefixesMetricHelp, labelNames)
+
 	// Create connection status gauge
-	brokerConnectionUp := prometheus.NewGauge(prometheus.GaugeOpts{
+	mm.brokerConnectionUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "mosquitto_broker_connected",
 		Help: "Connection status to the Mosquitto broker (1 = connected, 0 = disconnected)",
-	})
-	registry.GetRegistry().MustRegister(brokerConnectionUp)
-	registry.AddMetricInfo("mosquitto_broker_connected", "Connection status to the Mosquitto broker (1 = connected, 0 = disconnected)", []string{})
+	}, labelNames)
+	mm.register("mosquitto_broker_connected", mm.brokerConnectionUp)
+	mm.addMetricInfo("mosquitto_broker_connected", "Connection status to the Mosquitto broker (1 = connected, 0 = disconnected)", labelNames)
 
 	// Create last message timestamp gauge
-	lastMessageTimestamp := prometheus.NewGauge(prometheus.GaugeOpts{
+	mm.lastMessageTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "mosquitto_last_message_timestamp_seconds",
 		Help: "Unix timestamp of the last message received from the broker",
-	})
-	registry.GetRegistry().MustRegister(lastMessageTimestamp)
-	registry.AddMetricInfo("mosquitto_last_message_timestamp_seconds", "Unix timestamp of the last message received from the broker", []string{})
+	}, labelNames)
+	mm.register("mosquitto_last_message_timestamp_seconds", mm.lastMessageTimestamp)
+	mm.addMetricInfo("mosquitto_last_message_timestamp_seconds", "Unix timestamp of the last message received from the broker", labelNames)
 
 	// Create broker info gauge (value always 1; version is a label)
-	brokerInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	infoLabelNames := append(append([]string{}, labelNames...), "version")
+	mm.brokerInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "mosquitto_broker_info",
 		Help: "Static info about the Mosquitto broker (value is always 1)",
-	}, []string{"version"})
-	registry.GetRegistry().MustRegister(brokerInfo)
-	registry.AddMetricInfo("mosquitto_broker_info", "Static info about the Mosquitto broker (value is always 1)", []string{"version"})
+	}, infoLabelNames)
+	mm.register("mosquitto_broker_info", mm.brokerInfo)
+	mm.addMetricInfo("mosquitto_broker_info", "Static info about the Mosquitto broker (value is always 1)", infoLabelNames)
+
+	// Create broker restart metrics
+	mm.brokerRestarts = mm.newCounterVec("mosquitto_broker_restarts_total",
+		"Total number of broker restarts detected from uptime or byte counters going backwards")
+
+	mm.brokerStartTime = mm.newGaugeVec("mosquitto_broker_start_time_seconds",
+		"Estimated Unix timestamp at which the broker started, derived from its uptime")
+
+	// Create broker log counters
+	mm.logMessages = mm.newCounterVec("mosquitto_log_messages_total",
+		"Total number of broker log messages received, by severity", "severity")
+	mm.logConnections = mm.newCounterVec("mosquitto_log_client_connections_total",
+		"Total number of client connections reported in the broker log")
+	mm.logDisconnections = mm.newCounterVec("mosquitto_log_client_disconnections_total",
+		"Total number of client disconnections reported in the broker log, by reason", "reason")
+	mm.logAuthFailures = mm.newCounterVec("mosquitto_log_auth_failures_total",
+		"Total number of client authentication failures reported in the broker log, by client address", "address")
+	mm.logTakeovers = mm.newCounterVec("mosquitto_log_client_takeovers_total",
+		"Total number of connections closed because a client with the same ID connected, as reported in the broker log")
+
+	// Create exporter self-instrumentation
+	mm.connectAttempts = mm.newCounterVec("mosquitto_exporter_connect_attempts_total",
+		"Total number of attempts to connect to the broker, including automatic reconnects")
+	mm.connectFailures = mm.newCounterVec("mosquitto_exporter_connect_failures_total",
+		"Total number of failed attempts to connect to the broker, by error class", "class")
+	mm.connectDuration = mm.newHistogramVec("mosquitto_exporter_connect_duration_seconds",
+		"Time taken by successful attempts to connect to the broker",
+		prometheus.ExponentialBuckets(0.005, 2, 12))
+	mm.connectBackoff = mm.newGaugeVec("mosquitto_exporter_connect_backoff_seconds",
+		"Delay before the next attempt to connect to the broker (0 while connected or connecting)")
+	mm.connectFailureStreak = mm.newGaugeVec("mosquitto_exporter_connect_consecutive_failures",
+		"Number of failed attempts to connect to the broker since the last successful connection")
+	mm.lastConnectError = mm.newGaugeVec("mosquitto_exporter_last_connect_error_timestamp_seconds",
+		"Unix timestamp of the last failed attempt to connect to the broker, labelled with its error class", "class")
+	mm.connackReasons = mm.newCounterVec("mosquitto_exporter_connack_reason_codes_total",
+		"Total number of MQTT v5 CONNACK packets received from the broker, by reason code", "code", "reason")
+	mm.disconnectReasons = mm.newCounterVec("mosquitto_exporter_disconnect_reason_codes_total",
+		"Total number of MQTT v5 DISCONNECT packets sent by the broker to close the connection, by reason code", "code", "reason")
+	mm.sessionExpiry = mm.newGaugeVec("mosquitto_exporter_session_expiry_seconds",
+		"Session expiry interval in effect for the MQTT v5 session with the broker")
+	mm.subscribeFailures = mm.newCounterVec("mosquitto_exporter_subscribe_failures_total",
+		"Total number of failed or timed out subscriptions to $SYS/#")
+	mm.messagesReceived = mm.newCounterVec("mosquitto_exporter_messages_received_total",
+		"Total number of $SYS messages received, by subtree", "subtree")
+	mm.unparseablePayloads = mm.newCounterVec("mosquitto_exporter_unparseable_payloads_total",
+		"Total number of $SYS messages whose payload contained no number, by subtree", "subtree")
+	mm.ignoredTopics = mm.newCounterVec("mosquitto_exporter_ignored_messages_total",
+		"Total number of $SYS messages on ignored topics")
+	mm.handlerDuration = mm.newHistogramVec("mosquitto_exporter_message_handler_duration_seconds",
+		"Time taken to process a $SYS message",
+		prometheus.ExponentialBuckets(0.00001, 4, 10))
+	mm.topicMetricErrors = mm.newCounterVec("mosquitto_exporter_topic_metric_errors_total",
+		"Total number of messages on application topics a topic_metrics rule couldn't take a value from, by metric", "metric")
+
+	// Create topic group metrics; the classic buckets are for scrapers
+	// without native histogram support
+	mm.topicGroupSizes = mm.newNativeHistogramVec("mosquitto_topic_group_payload_size_bytes",
+		"Payload size of messages on the application topics of a topic group",
+		prometheus.ExponentialBuckets(16, 4, 8), "group")
+	mm.topicGroupGaps = mm.newNativeHistogramVec("mosquitto_topic_group_interarrival_seconds",
+		"Time between consecutive messages on the application topics of a topic group, excluding retained messages",
+		prometheus.ExponentialBuckets(0.001, 4, 10), "group")
+	mm.topicGroupMessages = mm.newCounterVec("mosquitto_topic_group_messages_total",
+		"Total number of messages received on the application topics of a topic group, by QoS and retain flag", "group", "qos", "retained")
+
+	// Create retained message census metrics
+	mm.censusTimestamp = mm.newGaugeVec("mosquitto_retained_census_timestamp_seconds",
+		"Unix timestamp at which the last successful retained message census started")
+	mm.censusDuration = mm.newGaugeVec("mosquitto_retained_census_duration_seconds",
+		"Time taken by the last successful retained message census")
+	mm.censusComplete = mm.newGaugeVec("mosquitto_retained_census_complete",
+		"Whether the last successful retained message census finished before timing out (1 = complete, 0 = cut short)")
+	mm.censusFailures = mm.newCounterVec("mosquitto_exporter_retained_census_failures_total",
+		"Total number of retained message censuses that failed to connect or subscribe")
+
+	// Create round-trip probe metrics; the in-flight durations are read at scrape time
+	mm.roundTripLatency = mm.newNativeHistogramVec("mosquitto_roundtrip_latency_seconds",
+		"Time from publishing a round-trip probe message to its delivery on the probe's subscription, by QoS",
+		prometheus.ExponentialBuckets(0.0005, 2, 14), "qos")
+	mm.roundTripProbes = mm.newCounterVec("mosquitto_roundtrip_probes_total",
+		"Total number of round-trip probe messages, by QoS and result (success, timeout, error)", "qos", "result")
+	mm.roundTripConnected = mm.newGaugeVec("mosquitto_roundtrip_connected",
+		"Connection status of the round-trip probe client (1 = connected, 0 = disconnected)")
+
+	mm.roundTrip = newRoundTripCollector(labelNames)
+	mm.register(roundTripInFlightMetricName, mm.roundTrip)
+	mm.addMetricInfo(roundTripInFlightMetricName, roundTripInFlightMetricHelp, append(append([]string{}, labelNames...), "qos"))
+
+	// Create TLS material metrics
+	mm.tlsCertNotAfter = mm.newGaugeVec("mosquitto_tls_client_cert_not_after_seconds",
+		"Unix timestamp at which the loaded client certificate expires")
+	mm.tlsReloadSuccess = mm.newGaugeVec("mosquitto_tls_last_reload_success",
+		"Whether the last load of the TLS certificate, key and CA files succeeded (1 = success, 0 = failure)")
+	mm.tlsReloadTimestamp = mm.newGaugeVec("mosquitto_tls_last_reload_timestamp_seconds",
+		"Unix timestamp of the last load of the TLS certificate, key and CA files")
+
+	// Create broker certificate metrics
+	mm.tlsServerNotAfter = mm.newGaugeVec("mosquitto_tls_server_cert_not_after_seconds",
+		"Unix timestamp at which the broker's certificate expires")
+	mm.tlsServerCertInfo = mm.newGaugeVec("mosquitto_tls_server_cert_info",
+		"Information about the broker's certificate (value is always 1)", "subject", "issuer", "sans", "serial")
+	mm.tlsServerChainLength = mm.newGaugeVec("mosquitto_tls_server_cert_chain_length",
+		"Number of certificates in the chain presented by the broker")
+	mm.tlsServerVerified = mm.newGaugeVec("mosquitto_tls_server_cert_verified",
+		"Whether the broker's certificate passed verification in the last handshake, even if verification is disabled (1 = verified, 0 = failed)")
+	mm.tlsServerVerifyError = mm.newGaugeVec("mosquitto_tls_server_cert_verify_error",
+		"Reason the broker's certificate failed verification in the last handshake (value is always 1)", "reason")
+	mm.tlsConnectionInfo = mm.newGaugeVec("mosquitto_tls_connection_info",
+		"The TLS version and cipher suite negotiated with the broker (value is always 1)", "version", "cipher")
+
+	return mm
+}
 
-	return &MosquittoMetrics{
-		registry:             registry,
-		counterMetrics:       make(map[string]*MosquittoCounter),
-		gaugeMetrics:         make(map[string]prometheus.Gauge),
-		brokerConnectionUp:   brokerConnectionUp,
-		lastMessageTimestamp: lastMessageTimestamp,
-		brokerInfo:           brokerInfo,
+// newGaugeVec registers a gauge family with the broker labels followed by extraLabelNames
+func (mm *MosquittoMetrics) newGaugeVec(name, help string, extraLabelNames ...string) *prometheus.GaugeVec {
+	labelNames := append(append([]string{}, mm.labelNames...), extraLabelNames...)
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: name,
+		Help: help,
+	}, labelNames)
+	mm.register(name, gauge)
+	mm.addMetricInfo(name, help, labelNames)
+
+	return gauge
+}
+
+// newHistogramVec registers a histogram family with the broker labels
+func (mm *MosquittoMetrics) newHistogramVec(name, help string, buckets []float64) *prometheus.HistogramVec {
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    name,
+		Help:    help,
+		Buckets: buckets,
+	}, mm.labelNames)
+	mm.register(name, histogram)
+	mm.addMetricInfo(name, help, mm.labelNames)
+
+	return histogram
+}
+
+// newNativeHistogramVec registers a histogram family with the broker labels
+// followed by extraLabelNames that is exported as a native histogram as well
+// as with the classic buckets
+func (mm *MosquittoMetrics) newNativeHistogramVec(name, help string, buckets []float64, extraLabelNames ...string) *prometheus.HistogramVec {
+	labelNames := append(append([]string{}, mm.labelNames...), extraLabelNames...)
+
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:                            name,
+		Help:                            help,
+		Buckets:                         buckets,
+		NativeHistogramBucketFactor:     1.1,
+		NativeHistogramMaxBucketNumber:  160,
+		NativeHistogramMinResetDuration: time.Hour,
+	}, labelNames)
+	mm.register(name, histogram)
+	mm.addMetricInfo(name, help, labelNames)
+
+	return histogram
+}
+
+// newCounterVec registers a counter family with the broker labels followed by extraLabelNames
+func (mm *MosquittoMetrics) newCounterVec(name, help string, extraLabelNames ...string) *prometheus.CounterVec {
+	labelNames := append(append([]string{}, mm.labelNames...), extraLabelNames...)
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: name,
+		Help: help,
+	}, labelNames)
+	mm.register(name, counter)
+	mm.addMetricInfo(name, help, labelNames)
+
+	return counter
+}
+
+// register registers a collector exporting the named metric and reserves the
+// name in the store, so no topic-derived family can collide with it
+func (mm *MosquittoMetrics) register(name string, collector prometheus.Collector) {
+	mm.registerer.MustRegister(collector)
+	mm.store.Reserve(name)
+}
+
+// addMetricInfo describes a metric in the web UI, if there is one
+func (mm *MosquittoMetrics) addMetricInfo(name, help string, labels []string) {
+	if mm.registry != nil {
+		mm.registry.AddMetricInfo(name, help, labels)
 	}
 }
 
@@ -88,108 +365,424 @@ func (mm *MosquittoMetrics) GetRegistry() *metrics.Registry {
 	return mm.registry
 }
 
+// LabelNames returns the broker label names attached to every broker-derived metric
+func (mm *MosquittoMetrics) LabelNames() []string {
+	return mm.labelNames
+}
+
 // ShouldIgnoreTopic returns true if the topic should be ignored
 func (mm *MosquittoMetrics) ShouldIgnoreTopic(topic string) bool {
 	_, ok := ignoreKeyMetrics[topic]
 	return ok
 }
 
-// IsCounterTopic returns true if the topic should be treated as a counter
-func (mm *MosquittoMetrics) IsCounterTopic(topic string) bool {
-	_, ok := counterKeyMetrics[topic]
-	return ok
+// MetricForTopic returns the metric a $SYS topic is exported as under the configured naming mode
+func (mm *MosquittoMetrics) MetricForTopic(topic string) topicMetric {
+	if mm.naming == NamingStructured {
+		return structuredMetricForTopic(topic)
+	}
+
+	return legacyMetricForTopic(topic)
 }
 
-// GetOrCreateCounter gets or creates a counter metric for the given topic
-func (mm *MosquittoMetrics) GetOrCreateCounter(topic, help string) *MosquittoCounter {
-	mm.mu.Lock()
-	defer mm.mu.Unlock()
+// SetTopicValue sets the value of the metric a topic maps to for a broker
+// and records when the topic was last updated. Counters count from the
+// broker's start time, which is exported as their created timestamp.
+func (mm *MosquittoMetrics) SetTopicValue(labelValues []string, topic string, metric topicMetric, value float64) {
+	labelNames := append(append([]string{}, mm.labelNames...), metric.LabelNames...)
+	values := append(append([]string{}, labelValues...), metric.LabelValues...)
+
+	valueType := prometheus.GaugeValue
+
+	var created time.Time
 
-	if counter, ok := mm.counterMetrics[topic]; ok {
-		return counter
+	if metric.Counter {
+		valueType = prometheus.CounterValue
+
+		mm.mu.RLock()
+		created = mm.startTimes[labelValues[0]]
+		mm.mu.RUnlock()
 	}
 
-	// Create new counter
-	counter := NewMosquittoCounter(prometheus.NewDesc(
-		topic,
-		help,
-		[]string{},
-		prometheus.Labels{},
-	))
+	if err := mm.store.Set(metric.Name, metric.Help, valueType, labelNames, values, value, created); err != nil {
+		slog.Debug("Dropping topic value", "metric", metric.Name, "error", err)
+	}
 
-	mm.counterMetrics[topic] = counter
-	mm.registry.GetRegistry().MustRegister(counter)
+	_ = mm.store.Set(lastUpdateMetricName, lastUpdateMetricHelp, prometheus.GaugeValue,
+		append(append([]string{}, mm.labelNames...), "topic"),
+		append(append([]string{}, labelValues...), topic),
+		float64(time.Now().UnixNano())/1e9,
+		time.Time{},
+	)
+}
 
-	// Add metric info for web UI
-	mm.registry.AddMetricInfo(topic, help, []string{})
+// SetTopicRuleValue sets the value of a metric taken from a message on an
+// application topic. Unlike SetTopicValue it doesn't record when the topic
+// was last updated, as application topics are unbounded, and the series
+// isn't expired, dropped on disconnect or dated by broker restarts.
+func (mm *MosquittoMetrics) SetTopicRuleValue(labelValues []string, metric topicMetric, value float64) {
+	labelNames := append(append([]string{}, mm.labelNames...), metric.LabelNames...)
+	values := append(append([]string{}, labelValues...), metric.LabelValues...)
+
+	valueType := prometheus.GaugeValue
+	if metric.Counter {
+		valueType = prometheus.CounterValue
+	}
 
-	return counter
+	if err := mm.store.SetApplication(metric.Name, metric.Help, valueType, labelNames, values, value); err != nil {
+		slog.Debug("Dropping topic value", "metric", metric.Name, "error", err)
+	}
+}
+
+// AddTrafficAccount exports the traffic account of a broker
+func (mm *MosquittoMetrics) AddTrafficAccount(labelValues []string, account *trafficAccount) {
+	mm.traffic.Add(labelValues, account)
+}
+
+// ExpireSeries removes the topic-derived series of a broker that haven't been updated since before
+func (mm *MosquittoMetrics) ExpireSeries(labelValues []string, before time.Time) {
+	mm.store.Expire(prometheus.Labels{"broker": labelValues[0]}, before)
+}
+
+// DropBrokerSeries removes all series derived from a broker's $SYS topics,
+// keeping the connection status and log counters
+func (mm *MosquittoMetrics) DropBrokerSeries(labelValues []string) {
+	labels := prometheus.Labels{"broker": labelValues[0]}
+
+	mm.store.DeleteAll(labels)
+	mm.brokerInfo.DeletePartialMatch(labels)
+}
+
+// DeleteSeries removes all series of the named topic-derived family matching labels
+func (mm *MosquittoMetrics) DeleteSeries(name string, labels prometheus.Labels) {
+	mm.store.Delete(name, labels)
+}
+
+// Naming returns the configured metric naming mode
+func (mm *MosquittoMetrics) Naming() string {
+	return mm.naming
 }
 
-// GetOrCreateGauge gets or creates a gauge metric for the given topic
-func (mm *MosquittoMetrics) GetOrCreateGauge(topic, help string) prometheus.Gauge {
+// InitBroker exports the initial state of a broker before anything is received from it
+func (mm *MosquittoMetrics) InitBroker(labelValues []string) {
+	mm.SetBrokerConnected(labelValues, false)
+	mm.SetConnectBackoff(labelValues, 0, 0)
+	mm.brokerRestarts.WithLabelValues(labelValues...).Add(0)
+}
+
+// SetBrokerConnected sets the connection status of a broker
+func (mm *MosquittoMetrics) SetBrokerConnected(labelValues []string, connected bool) {
+	if connected {
+		mm.brokerConnectionUp.WithLabelValues(labelValues...).Set(1)
+	} else {
+		mm.brokerConnectionUp.WithLabelValues(labelValues...).Set(0)
+	}
+}
+
+// UpdateLastMessageTimestamp updates the last message timestamp of a broker to current time
+func (mm *MosquittoMetrics) UpdateLastMessageTimestamp(labelValues []string) {
+	mm.lastMessageTimestamp.WithLabelValues(labelValues...).SetToCurrentTime()
+}
+
+// SetBrokerVersion records the broker version in the info metric.
+// Any previously set version label for the broker is deleted so the metric
+// always has exactly one series per broker.
+func (mm *MosquittoMetrics) SetBrokerVersion(labelValues []string, version string) {
+	mm.brokerInfo.DeletePartialMatch(prometheus.Labels{"broker": labelValues[0]})
+	mm.brokerInfo.WithLabelValues(append(append([]string{}, labelValues...), version)...).Set(1)
+}
+
+// RecordBrokerRestart counts a detected restart of a broker. Its start time
+// is unknown until the next uptime value.
+func (mm *MosquittoMetrics) RecordBrokerRestart(labelValues []string) {
+	mm.brokerRestarts.WithLabelValues(labelValues...).Inc()
+	mm.SetBrokerStartTime(labelValues, time.Time{})
+}
+
+// SetBrokerStartTime records when a broker started and uses it as the created
+// timestamp of its counters. A zero startTime clears it.
+func (mm *MosquittoMetrics) SetBrokerStartTime(labelValues []string, startTime time.Time) {
 	mm.mu.Lock()
-	defer mm.mu.Unlock()
+	mm.startTimes[labelValues[0]] = startTime
+	mm.mu.Unlock()
 
-	if gauge, ok := mm.gaugeMetrics[topic]; ok {
-		return gauge
+	mm.store.SetCreated(prometheus.Labels{"broker": labelValues[0]}, startTime)
+
+	if startTime.IsZero() {
+		mm.brokerStartTime.DeletePartialMatch(prometheus.Labels{"broker": labelValues[0]})
+		return
 	}
 
-	// Create new gauge
-	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: topic,
-		Help: help,
-	})
+	mm.brokerStartTime.WithLabelValues(labelValues...).Set(float64(startTime.UnixNano()) / 1e9)
+}
 
-	mm.gaugeMetrics[topic] = gauge
-	mm.registry.GetRegistry().MustRegister(gauge)
+// IncConnectAttempt counts an attempt to connect to a broker
+func (mm *MosquittoMetrics) IncConnectAttempt(labelValues []string) {
+	mm.connectAttempts.WithLabelValues(labelValues...).Inc()
+}
 
-	// Add metric info for web UI
-	mm.registry.AddMetricInfo(topic, help, []string{})
+// IncConnectFailure counts a failed attempt to connect to a broker
+func (mm *MosquittoMetrics) IncConnectFailure(labelValues []string, class string) {
+	mm.connectFailures.WithLabelValues(append(append([]string{}, labelValues...), class)...).Inc()
+}
 
-	return gauge
+// ObserveConnectDuration records how long a successful connection attempt took
+func (mm *MosquittoMetrics) ObserveConnectDuration(labelValues []string, duration time.Duration) {
+	mm.connectDuration.WithLabelValues(labelValues...).Observe(duration.Seconds())
+}
+
+// SetConnectBackoff records the delay before the next attempt to connect to
+// a broker and how many attempts in a row have failed
+func (mm *MosquittoMetrics) SetConnectBackoff(labelValues []string, delay time.Duration, failures int) {
+	mm.connectBackoff.WithLabelValues(labelValues...).Set(delay.Seconds())
+	mm.connectFailureStreak.WithLabelValues(labelValues...).Set(float64(failures))
+}
+
+// SetLastConnectError records the class and time of the last failed attempt
+// to connect to a broker, replacing the previous one
+func (mm *MosquittoMetrics) SetLastConnectError(labelValues []string, class string, t time.Time) {
+	mm.lastConnectError.DeletePartialMatch(prometheus.Labels{"broker": labelValues[0]})
+	mm.lastConnectError.WithLabelValues(append(append([]string{}, labelValues...), class)...).Set(float64(t.UnixNano()) / 1e9)
+}
+
+// IncConnackReason counts an MQTT v5 CONNACK with the given reason code
+func (mm *MosquittoMetrics) IncConnackReason(labelValues []string, code byte, reason string) {
+	mm.connackReasons.WithLabelValues(append(append([]string{}, labelValues...), fmt.Sprintf("0x%02X", code), reason)...).Inc()
+}
+
+// IncDisconnectReason counts an MQTT v5 DISCONNECT from the broker with the given reason code
+func (mm *MosquittoMetrics) IncDisconnectReason(labelValues []string, code byte, reason string) {
+	mm.disconnectReasons.WithLabelValues(append(append([]string{}, labelValues...), fmt.Sprintf("0x%02X", code), reason)...).Inc()
+}
+
+// SetSessionExpiry records the session expiry interval granted by the broker
+func (mm *MosquittoMetrics) SetSessionExpiry(labelValues []string, expiry time.Duration) {
+	mm.sessionExpiry.WithLabelValues(labelValues...).Set(expiry.Seconds())
+}
+
+// IncSubscribeFailure counts a failed subscription to $SYS/#
+func (mm *MosquittoMetrics) IncSubscribeFailure(labelValues []string) {
+	mm.subscribeFailures.WithLabelValues(labelValues...).Inc()
+}
+
+// IncMessageReceived counts a $SYS message received in the given subtree
+func (mm *MosquittoMetrics) IncMessageReceived(labelValues []string, subtree string) {
+	mm.messagesReceived.WithLabelValues(append(append([]string{}, labelValues...), subtree)...).Inc()
+}
+
+// IncUnparseablePayload counts a $SYS message in the given subtree without a number in its payload
+func (mm *MosquittoMetrics) IncUnparseablePayload(labelValues []string, subtree string) {
+	mm.unparseablePayloads.WithLabelValues(append(append([]string{}, labelValues...), subtree)...).Inc()
+}
+
+// IncIgnoredTopic counts a $SYS message on an ignored topic
+func (mm *MosquittoMetrics) IncIgnoredTopic(labelValues []string) {
+	mm.ignoredTopics.WithLabelValues(labelValues...).Inc()
 }
 
-// SetCounterValue sets the value of a counter metric
-func (mm *MosquittoMetrics) SetCounterValue(topic string, value float64) {
-	help := counterKeyMetrics[topic]
-	if help == "" {
-		help = topic
+// ObserveHandlerDuration records how long processing a $SYS message took
+func (mm *MosquittoMetrics) ObserveHandlerDuration(labelValues []string, duration time.Duration) {
+	mm.handlerDuration.WithLabelValues(labelValues...).Observe(duration.Seconds())
+}
+
+// IncTopicMetricError counts a message a topic_metrics rule couldn't take a value from
+func (mm *MosquittoMetrics) IncTopicMetricError(labelValues []string, metric string) {
+	mm.topicMetricErrors.WithLabelValues(append(append([]string{}, labelValues...), metric)...).Inc()
+}
+
+// EnableRetainedCensus registers the collector of the last retained message
+// census, which like the store is read at scrape time. It must be called
+// before any census is set.
+func (mm *MosquittoMetrics) EnableRetainedCensus() {
+	mm.retained = newRetainedCollector(mm.labelNames)
+	mm.registerer.MustRegister(mm.retained)
+
+	for name, help := range map[string]string{
+		retainedMessagesMetricName: retainedMessagesMetricHelp,
+		retainedBytesMetricName:    retainedBytesMetricHelp,
+		retainedAgeMetricName:      retainedAgeMetricHelp,
+		retainedUndatedMetricName:  retainedUndatedMetricHelp,
+	} {
+		mm.store.Reserve(name)
+		mm.addMetricInfo(name, help, append(append([]string{}, mm.labelNames...), "prefix"))
 	}
+}
 
-	// Add _total suffix to counter names following Prometheus naming conventions
-	metricName := topic
-	if !strings.HasSuffix(metricName, "_total") {
-		metricName = metricName + "_total"
+// SetRetainedCensus exports the result of a retained message census
+func (mm *MosquittoMetrics) SetRetainedCensus(labelValues []string, census *retainedCensus) {
+	mm.retained.Set(labelValues, census)
+	mm.censusTimestamp.WithLabelValues(labelValues...).Set(float64(census.Time.UnixNano()) / 1e9)
+	mm.censusDuration.WithLabelValues(labelValues...).Set(census.Duration)
+
+	if census.Complete {
+		mm.censusComplete.WithLabelValues(labelValues...).Set(1)
+	} else {
+		mm.censusComplete.WithLabelValues(labelValues...).Set(0)
 	}
+}
 
-	counter := mm.GetOrCreateCounter(metricName, help)
-	counter.Set(value)
+// IncRetainedCensusFailure counts a failed retained message census
+func (mm *MosquittoMetrics) IncRetainedCensusFailure(labelValues []string) {
+	mm.censusFailures.WithLabelValues(labelValues...).Inc()
 }
 
-// SetGaugeValue sets the value of a gauge metric
-func (mm *MosquittoMetrics) SetGaugeValue(topic string, value float64) {
-	gauge := mm.GetOrCreateGauge(topic, topic)
-	gauge.Set(value)
+// RecordRoundTrip records the result of a round-trip probe message, and its
+// latency if it was delivered
+func (mm *MosquittoMetrics) RecordRoundTrip(labelValues []string, qos int, result string, latency time.Duration) {
+	values := append(append([]string{}, labelValues...), strconv.Itoa(qos))
+	mm.roundTripProbes.WithLabelValues(append(values, result)...).Inc()
+
+	if result == roundTripSuccess {
+		mm.roundTripLatency.WithLabelValues(values...).Observe(latency.Seconds())
+	}
 }
 
-// SetBrokerConnected sets the broker connection status
-func (mm *MosquittoMetrics) SetBrokerConnected(connected bool) {
+// SetRoundTripConnected records the connection status of the round-trip probe client
+func (mm *MosquittoMetrics) SetRoundTripConnected(labelValues []string, connected bool) {
 	if connected {
-		mm.brokerConnectionUp.Set(1)
+		mm.roundTripConnected.WithLabelValues(labelValues...).Set(1)
 	} else {
-		mm.brokerConnectionUp.Set(0)
+		mm.roundTripConnected.WithLabelValues(labelValues...).Set(0)
 	}
 }
 
-// UpdateLastMessageTimestamp updates the last message timestamp to current time
-func (mm *MosquittoMetrics) UpdateLastMessageTimestamp() {
-	mm.lastMessageTimestamp.SetToCurrentTime()
+// AddRoundTripProber exports the in-flight durations of a broker's round-trip prober
+func (mm *MosquittoMetrics) AddRoundTripProber(labelValues []string, prober *roundTripProber) {
+	mm.roundTrip.Add(labelValues, prober)
 }
 
-// SetBrokerVersion records the broker version in the info metric.
-// Any previously set version label is deleted so the metric always has exactly one series.
-func (mm *MosquittoMetrics) SetBrokerVersion(version string) {
-	mm.brokerInfo.Reset()
-	mm.brokerInfo.With(prometheus.Labels{"version": version}).Set(1)
+// TopicGroupMetrics returns the metrics of a broker's topic group
+func (mm *MosquittoMetrics) TopicGroupMetrics(labelValues []string, group string) *topicGroupMetrics {
+	values := append(append([]string{}, labelValues...), group)
+	tgm := &topicGroupMetrics{
+		payloadSize:  mm.topicGroupSizes.WithLabelValues(values...),
+		interarrival: mm.topicGroupGaps.WithLabelValues(values...),
+	}
+
+	for qos := range tgm.messages {
+		for retained := range tgm.messages[qos] {
+			// The QoS of messages received through a lower QoS subscription is unknown
+			qosLabel := strconv.Itoa(qos)
+			if qos == topicGroupCappedQoS {
+				qosLabel = ""
+			}
+
+			tgm.messages[qos][retained] = mm.topicGroupMessages.WithLabelValues(
+				append(append([]string{}, values...), qosLabel, strconv.FormatBool(retained == 1))...)
+		}
+	}
+
+	return tgm
+}
+
+// SetTLSReloadResult records the result of loading a broker's TLS material
+// and the expiry of the client certificate now in use, if any
+func (mm *MosquittoMetrics) SetTLSReloadResult(labelValues []string, success bool, notAfter time.Time) {
+	mm.tlsReloadTimestamp.WithLabelValues(labelValues...).SetToCurrentTime()
+
+	if success {
+		mm.tlsReloadSuccess.WithLabelValues(labelValues...).Set(1)
+	} else {
+		mm.tlsReloadSuccess.WithLabelValues(labelValues...).Set(0)
+	}
+
+	if notAfter.IsZero() {
+		mm.tlsCertNotAfter.DeleteLabelValues(labelValues...)
+		return
+	}
+
+	mm.tlsCertNotAfter.WithLabelValues(labelValues...).Set(float64(notAfter.Unix()))
+}
+
+// SetTLSServerCertificate records the certificate chain a broker presented
+// and the result of verifying it
+func (mm *MosquittoMetrics) SetTLSServerCertificate(labelValues []string, chain []*x509.Certificate, verifyErr error) {
+	broker := prometheus.Labels{"broker": labelValues[0]}
+	with := func(extra ...string) []string {
+		return append(append([]string{}, labelValues...), extra...)
+	}
+
+	mm.tlsServerVerifyError.DeletePartialMatch(broker)
+
+	if verifyErr != nil {
+		mm.tlsServerVerified.WithLabelValues(labelValues...).Set(0)
+		mm.tlsServerVerifyError.WithLabelValues(with(verifyErrorReason(verifyErr))...).Set(1)
+	} else {
+		mm.tlsServerVerified.WithLabelValues(labelValues...).Set(1)
+	}
+
+	if len(chain) == 0 {
+		return
+	}
+
+	leaf := chain[0]
+
+	mm.tlsServerNotAfter.WithLabelValues(labelValues...).Set(float64(leaf.NotAfter.Unix()))
+	mm.tlsServerChainLength.WithLabelValues(labelValues...).Set(float64(len(chain)))
+
+	mm.tlsServerCertInfo.DeletePartialMatch(broker)
+	mm.tlsServerCertInfo.WithLabelValues(with(leaf.Subject.String(), leaf.Issuer.String(), certificateSANs(leaf), leaf.SerialNumber.Text(16))...).Set(1)
+}
+
+// SetTLSConnection records the TLS version and cipher suite negotiated with a broker
+func (mm *MosquittoMetrics) SetTLSConnection(labelValues []string, state tls.ConnectionState) {
+	mm.tlsConnectionInfo.DeletePartialMatch(prometheus.Labels{"broker": labelValues[0]})
+	mm.tlsConnectionInfo.WithLabelValues(append(append([]string{}, labelValues...),
+		tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))...).Set(1)
+}
+
+// authFailureAddress returns the label value to count an authentication
+// failure from address under. Addresses on failed logins are attacker
+// controlled, so only the first maxAuthFailureAddresses distinct ones of a
+// broker are reported as-is.
+func (mm *MosquittoMetrics) authFailureAddress(labelValues []string, address string) string {
+	if address == "" {
+		return "unknown"
+	}
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	addresses := mm.authFailureAddresses[labelValues[0]]
+	if addresses == nil {
+		addresses = make(map[string]bool)
+		mm.authFailureAddresses[labelValues[0]] = addresses
+	}
+
+	if addresses[address] {
+		return address
+	}
+
+	if len(addresses) >= maxAuthFailureAddresses {
+		return "other"
+	}
+
+	addresses[address] = true
+
+	return address
+}
+
+// IncLogMessage counts a broker log message of the given severity
+func (mm *MosquittoMetrics) IncLogMessage(labelValues []string, severity string) {
+	mm.logMessages.WithLabelValues(append(append([]string{}, labelValues...), severity)...).Inc()
+}
+
+// RecordLogEvent counts the client activity reported by a broker log line
+func (mm *MosquittoMetrics) RecordLogEvent(labelValues []string, event logEvent) {
+	with := func(extra ...string) []string {
+		return append(append([]string{}, labelValues...), extra...)
+	}
+
+	switch event.kind {
+	case logEventConnect:
+		mm.logConnections.WithLabelValues(labelValues...).Inc()
+	case logEventDisconnect:
+		mm.logDisconnections.WithLabelValues(with(event.reason)...).Inc()
+	case logEventAuthFailure:
+		mm.logAuthFailures.WithLabelValues(with(mm.authFailureAddress(labelValues, event.address))...).Inc()
+		mm.logDisconnections.WithLabelValues(with(event.reason)...).Inc()
+	case logEventTakeover:
+		mm.logTakeovers.WithLabelValues(labelValues...).Inc()
+	case logEventNone:
+	}
 }
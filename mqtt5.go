@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// v5Settings holds the MQTT v5 specific settings of a broker connection
+type v5Settings struct {
+	// sessionExpiry is the requested session expiry interval in seconds; 0
+	// ends the session with the connection
+	sessionExpiry  uint32
+	userProperties paho.UserProperties
+
+	// onConnack is called with every CONNACK, including ones refusing the connection
+	onConnack func(*paho.Connack)
+
+	// onDisconnect is called when the broker closes the connection with a DISCONNECT
+	onDisconnect func(*paho.Disconnect)
+}
+
+// v5Client is an MQTT v5 client behind the mqtt.Client interface of the v3
+// client, so that brokers speaking either version share the connection
+// handling and message processing. It takes the endpoint, credentials, TLS
+// settings, dialer and callbacks from the same mqtt.ClientOptions, and
+// like the v3 client with auto reconnect disabled, leaves reconnecting to
+// the caller.
+type v5Client struct {
+	options  *mqtt.ClientOptions
+	settings v5Settings
+	router   *paho.StandardRouter
+
+	// session keeps in-flight QoS 1 and 2 state across connections
+	session *state.State
+
+	mu     sync.Mutex
+	conn   *paho.Client       // the open connection, nil while disconnected
+	cancel context.CancelFunc // aborts the connection attempt in progress
+}
+
+// newV5Client creates an MQTT v5 client. Only the first broker of options is used.
+func newV5Client(options *mqtt.ClientOptions, settings v5Settings) *v5Client {
+	c := &v5Client{
+		options:  options,
+		settings: settings,
+		router:   paho.NewStandardRouter(),
+		session:  state.NewInMemory(),
+	}
+
+	// As with the v3 client, messages without a route of their own go to the
+	// default publish handler
+	if options.DefaultPublishHandler != nil {
+		c.router.DefaultHandler(func(p *paho.Publish) {
+			options.DefaultPublishHandler(c, &v5Message{publish: p})
+		})
+	}
+
+	return c
+}
+
+// IsConnected returns true if the client is connected to the broker
+func (c *v5Client) IsConnected() bool {
+	return c.connection() != nil
+}
+
+// IsConnectionOpen returns true if the client is connected to the broker
+func (c *v5Client) IsConnectionOpen() bool {
+	return c.connection() != nil
+}
+
+// Connect connects to the broker once
+func (c *v5Client) Connect() mqtt.Token {
+	ctx, cancel := connectContext(*c.options)
+
+	c.mu.Lock()
+	c.cancel = cancel
+	c.mu.Unlock()
+
+	return newV5Token(func() error {
+		defer cancel()
+
+		return c.connect(ctx)
+	})
+}
+
+// connect opens the network connection and performs the MQTT handshake,
+// calling the callbacks of the options like the v3 client does
+func (c *v5Client) connect(ctx context.Context) error {
+	c.notify(mqtt.ConnectionNotificationConnecting{Attempt: 1})
+
+	conn, err := c.handshake(ctx)
+	if err != nil {
+		c.notify(mqtt.ConnectionNotificationFailed{Reason: err})
+		return err
+	}
+
+	c.mu.Lock()
+	if ctx.Err() != nil {
+		// Disconnect was called while the handshake completed
+		c.mu.Unlock()
+
+		_ = conn.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		c.notify(mqtt.ConnectionNotificationFailed{Reason: ctx.Err()})
+
+		return ctx.Err()
+	}
+
+	c.conn = conn
+	c.mu.Unlock()
+
+	c.notify(mqtt.ConnectionNotificationConnected{})
+
+	if c.options.OnConnect != nil {
+		go c.options.OnConnect(c)
+	}
+
+	return nil
+}
+
+// handshake dials the broker and sends CONNECT, returning the connection once
+// the broker accepted it
+func (c *v5Client) handshake(ctx context.Context) (*paho.Client, error) {
+	if len(c.options.Servers) == 0 {
+		return nil, errors.New("no broker configured")
+	}
+
+	open := c.options.CustomOpenConnectionFn
+	if open == nil {
+		open = openDirectConnection
+	}
+
+	netConn, err := open(c.options.Servers[0], *c.options)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *paho.Client
+
+	conn = paho.NewClient(paho.ClientConfig{
+		ClientID: c.options.ClientID,
+		// tls.Conn and the WebSocket connection don't support concurrent writes
+		Conn:    packets.NewThreadSafeConn(netConn),
+		Session: c.session,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+			func(received paho.PublishReceived) (bool, error) {
+				c.router.Route(received.Packet.Packet())
+				return true, nil
+			},
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			c.serverDisconnected(conn, d)
+		},
+		OnClientError: func(err error) {
+			c.connectionLost(conn, err)
+		},
+	})
+
+	sessionExpiry := c.settings.sessionExpiry
+	connect := &paho.Connect{
+		ClientID:     c.options.ClientID,
+		KeepAlive:    uint16(min(max(c.options.KeepAlive, 0), 0xFFFF)), //nolint:gosec // clamped to the range of uint16
+		CleanStart:   sessionExpiry == 0,
+		Username:     c.options.Username,
+		UsernameFlag: c.options.Username != "",
+		Password:     []byte(c.options.Password),
+		PasswordFlag: c.options.Password != "",
+		Properties: &paho.ConnectProperties{
+			SessionExpiryInterval: &sessionExpiry,
+			User:                  c.settings.userProperties,
+			RequestProblemInfo:    true,
+		},
+	}
+
+	connack, err := conn.Connect(ctx, connect)
+	if connack != nil && c.settings.onConnack != nil {
+		c.settings.onConnack(connack)
+	}
+
+	if err != nil {
+		_ = netConn.Close()
+
+		if connack != nil && connack.ReasonCode >= 0x80 {
+			connErr := &connackError{code: connack.ReasonCode}
+			if connack.Properties != nil {
+				connErr.reason = connack.Properties.ReasonString
+			}
+
+			return nil, connErr
+		}
+
+		return nil, errors.Join(err, ctx.Err())
+	}
+
+	return conn, nil
+}
+
+// serverDisconnected handles a DISCONNECT sent by the broker
+func (c *v5Client) serverDisconnected(conn *paho.Client, d *paho.Disconnect) {
+	if c.settings.onDisconnect != nil {
+		c.settings.onDisconnect(d)
+	}
+
+	err := &disconnectError{code: d.ReasonCode}
+	if d.Properties != nil {
+		err.reason = d.Properties.ReasonString
+	}
+
+	c.connectionLost(conn, err)
+}
+
+// connectionLost reports the loss of conn, unless it was already reported or
+// closed by Disconnect
+func (c *v5Client) connectionLost(conn *paho.Client, err error) {
+	c.mu.Lock()
+	if c.conn != conn {
+		c.mu.Unlock()
+		return
+	}
+
+	c.conn = nil
+	c.mu.Unlock()
+
+	c.notify(mqtt.ConnectionNotificationLost{Reason: err})
+
+	if c.options.OnConnectionLost != nil {
+		go c.options.OnConnectionLost(c, err)
+	}
+}
+
+// Disconnect closes the connection and aborts a connection attempt in
+// progress. Unlike the v3 client it doesn't wait for pending work, so
+// quiesce is ignored.
+func (c *v5Client) Disconnect(_ uint) {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.mu.Unlock()
+
+	if conn != nil {
+		_ = conn.Disconnect(&paho.Disconnect{ReasonCode: 0})
+	}
+}
+
+// Publish publishes a message; payload may be a string, []byte or bytes.Buffer
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	conn := c.connection()
+
+	return newV5Token(func() error {
+		if conn == nil {
+			return mqtt.ErrNotConnected
+		}
+
+		var data []byte
+
+		switch p := payload.(type) {
+		case string:
+			data = []byte(p)
+		case []byte:
+			data = p
+		case bytes.Buffer:
+			data = p.Bytes()
+		case *bytes.Buffer:
+			data = p.Bytes()
+		default:
+			return fmt.Errorf("unknown payload type %T", payload)
+		}
+
+		ctx, cancel := connectContext(*c.options)
+		defer cancel()
+
+		_, err := conn.Publish(ctx, &paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: data})
+
+		return err
+	})
+}
+
+// Subscribe subscribes to a topic filter, routing its messages to callback
+func (c *v5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// SubscribeMultiple subscribes to several topic filters, routing their messages to callback
+func (c *v5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	conn := c.connection()
+
+	return newV5Token(func() error {
+		if conn == nil {
+			return mqtt.ErrNotConnected
+		}
+
+		subscribe := &paho.Subscribe{}
+
+		for topic, qos := range filters {
+			subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+
+			// Routes are set up first so that retained messages aren't missed
+			if callback != nil {
+				c.AddRoute(topic, callback)
+			}
+		}
+
+		ctx, cancel := connectContext(*c.options)
+		defer cancel()
+
+		suback, err := conn.Subscribe(ctx, subscribe)
+		if suback != nil {
+			for i, code := range suback.Reasons {
+				if code >= 0x80 && i < len(subscribe.Subscriptions) {
+					return fmt.Errorf("subscription to %s refused: %s (reason code 0x%02X)",
+						subscribe.Subscriptions[i].Topic, subackReason(code), code)
+				}
+			}
+		}
+
+		return err
+	})
+}
+
+// Unsubscribe ends the subscriptions to the given topic filters
+func (c *v5Client) Unsubscribe(topics ...string) mqtt.Token {
+	conn := c.connection()
+
+	for _, topic := range topics {
+		c.router.UnregisterHandler(topic)
+	}
+
+	return newV5Token(func() error {
+		if conn == nil {
+			return mqtt.ErrNotConnected
+		}
+
+		ctx, cancel := connectContext(*c.options)
+		defer cancel()
+
+		_, err := conn.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+
+		return err
+	})
+}
+
+// AddRoute routes messages matching topic to callback, replacing any previous route
+func (c *v5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.router.UnregisterHandler(topic)
+	c.router.RegisterHandler(topic, func(p *paho.Publish) {
+		callback(c, &v5Message{publish: p})
+	})
+}
+
+// OptionsReader returns the options the client was created with
+func (c *v5Client) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.NewOptionsReader(c.options)
+}
+
+// connection returns the open connection, or nil
+func (c *v5Client) connection() *paho.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn
+}
+
+// notify calls the connection notification handler of the options, if any
+func (c *v5Client) notify(notification mqtt.ConnectionNotification) {
+	if c.options.OnConnectionNotification != nil {
+		c.options.OnConnectionNotification(c, notification)
+	}
+}
+
+// v5Message is a received MQTT v5 PUBLISH behind the mqtt.Message interface
+type v5Message struct {
+	publish *paho.Publish
+}
+
+func (m *v5Message) Duplicate() bool   { return m.publish.Duplicate() }
+func (m *v5Message) Qos() byte         { return m.publish.QoS }
+func (m *v5Message) Retained() bool    { return m.publish.Retain }
+func (m *v5Message) Topic() string     { return m.publish.Topic }
+func (m *v5Message) MessageID() uint16 { return m.publish.PacketID }
+func (m *v5Message) Payload() []byte   { return m.publish.Payload }
+
+// Ack does nothing; the v5 client acknowledges messages itself
+func (m *v5Message) Ack() {}
+
+// v5Token is the mqtt.Token of an operation of the v5 client, which runs in
+// its own goroutine
+type v5Token struct {
+	done chan struct{}
+	err  error
+}
+
+// newV5Token runs op and returns a token that completes with its result
+func newV5Token(op func() error) *v5Token {
+	t := &v5Token{done: make(chan struct{})}
+
+	go func() {
+		t.err = op()
+		close(t.done)
+	}()
+
+	return t
+}
+
+// Wait waits for the operation to complete
+func (t *v5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+// WaitTimeout waits up to d for the operation to complete, returning false on timeout
+func (t *v5Token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Done returns a channel that is closed when the operation completes
+func (t *v5Token) Done() <-chan struct{} {
+	return t.done
+}
+
+// Error returns the error of the completed operation
+func (t *v5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// connackReason returns the name of a CONNACK reason code, e.g. "Not authorized"
+func connackReason(code byte) string {
+	return reasonName((&packets.Connack{ReasonCode: code}).Reason())
+}
+
+// disconnectReason returns the name of a DISCONNECT reason code, e.g. "Session taken over"
+func disconnectReason(code byte) string {
+	return reasonName((&packets.Disconnect{ReasonCode: code}).Reason())
+}
+
+// subackReason returns the name of a SUBACK reason code, e.g. "Not authorized"
+func subackReason(code byte) string {
+	return reasonName((&packets.Suback{Reasons: []byte{code}}).Reason(0))
+}
+
+// reasonName returns the name from a reason code description of the packets
+// package, which is followed by " - " and an explanation
+func reasonName(description string) string {
+	name, _, _ := strings.Cut(description, " - ")
+	if name == "" {
+		return "Unknown"
+	}
+
+	return name
+}
+
+// formatUserProperties formats user properties as sorted key=value pairs, for logging
+func formatUserProperties(props paho.UserProperties) []string {
+	formatted := make([]string, 0, len(props))
+	for _, prop := range props {
+		formatted = append(formatted, prop.Key+"="+prop.Value)
+	}
+
+	sort.Strings(formatted)
+
+	return formatted
+}
+
+// The adapters must satisfy the interfaces of the v3 client
+var (
+	_ mqtt.Client  = (*v5Client)(nil)
+	_ mqtt.Message = (*v5Message)(nil)
+	_ mqtt.Token   = (*v5Token)(nil)
+)
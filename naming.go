@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+)
+
+// Metric naming modes
+const (
+	// NamingLegacy flattens $SYS topics into metric names (the original behaviour)
+	NamingLegacy = "legacy"
+	// NamingStructured maps known $SYS topics to mosquitto_-prefixed metric
+	// families with labels and unit suffixes
+	NamingStructured = "structured"
+)
+
+// topicMetric describes the metric series a $SYS topic is exported as
+type topicMetric struct {
+	Name        string
+	Help        string
+	Counter     bool
+	LabelNames  []string
+	LabelValues []string
+}
+
+// structuredRule maps topics matching pattern to a metric family. Pattern
+// segments of the form "+name" match any single topic level and export it
+// as the label "name". fixed optionally adds a constant label name/value pair
+// for rules whose distinguishing topic level is spelled out in the pattern.
+type structuredRule struct {
+	pattern string
+	name    string
+	help    string
+	counter bool
+	fixed   [2]string
+
+	segments []string
+}
+
+// structuredRules is the curated mapping table used in structured naming mode.
+// The first matching rule wins.
+var structuredRules = compileStructuredRules([]structuredRule{
+	// Totals since broker start
+	{pattern: "$SYS/broker/bytes/+direction", name: "mosquitto_bytes_total", counter: true, help: "The total number of bytes received or sent since the broker started."},
+	{pattern: "$SYS/broker/messages/received", fixed: [2]string{"direction", "received"}, name: "mosquitto_messages_total", counter: true, help: "The total number of messages of any type received or sent since the broker started."},
+	{pattern: "$SYS/broker/messages/sent", fixed: [2]string{"direction", "sent"}, name: "mosquitto_messages_total", counter: true, help: "The total number of messages of any type received or sent since the broker started."},
+	{pattern: "$SYS/broker/publish/bytes/+direction", name: "mosquitto_publish_bytes_total", counter: true, help: "The total number of PUBLISH bytes received or sent since the broker started."},
+	{pattern: "$SYS/broker/publish/messages/dropped", name: "mosquitto_publish_messages_dropped_total", counter: true, help: "The total number of PUBLISH messages that have been dropped due to inflight/queuing limits."},
+	{pattern: "$SYS/broker/publish/messages/+direction", name: "mosquitto_publish_messages_total", counter: true, help: "The total number of PUBLISH messages received or sent since the broker started."},
+	{pattern: "$SYS/broker/clients/expired", name: "mosquitto_clients_expired_total", counter: true, help: "The total number of disconnected persistent clients that have been expired and removed."},
+
+	// Current state
+	{pattern: "$SYS/broker/uptime", name: "mosquitto_uptime_seconds", help: "The number of seconds since the broker started."},
+	{pattern: "$SYS/broker/clients/connected", fixed: [2]string{"state", "connected"}, name: "mosquitto_clients", help: "The number of clients by connection state."},
+	{pattern: "$SYS/broker/clients/disconnected", fixed: [2]string{"state", "disconnected"}, name: "mosquitto_clients", help: "The number of clients by connection state."},
+	{pattern: "$SYS/broker/clients/total", name: "mosquitto_clients_registered", help: "The number of connected and disconnected clients registered with the broker."},
+	{pattern: "$SYS/broker/clients/maximum", name: "mosquitto_clients_maximum", help: "The maximum number of clients connected simultaneously since the broker started."},
+	{pattern: "$SYS/broker/heap/current", name: "mosquitto_heap_current_bytes", help: "The current size of the heap memory in use by the broker."},
+	{pattern: "$SYS/broker/heap/maximum", name: "mosquitto_heap_maximum_bytes", help: "The largest amount of heap memory used by the broker."},
+	{pattern: "$SYS/broker/messages/inflight", name: "mosquitto_messages_inflight", help: "The number of messages with QoS>0 that are awaiting acknowledgments."},
+	{pattern: "$SYS/broker/messages/stored", name: "mosquitto_messages_stored", help: "The number of messages currently held in the message store."},
+	{pattern: "$SYS/broker/store/messages/count", name: "mosquitto_store_messages", help: "The number of messages currently held in the message store."},
+	{pattern: "$SYS/broker/store/messages/bytes", name: "mosquitto_store_messages_bytes", help: "The number of bytes currently held by message payloads in the message store."},
+	{pattern: "$SYS/broker/retained messages/count", name: "mosquitto_retained_messages", help: "The total number of retained messages active on the broker."},
+	{pattern: "$SYS/broker/subscriptions/count", name: "mosquitto_subscriptions", help: "The total number of subscriptions active on the broker."},
+	{pattern: "$SYS/broker/shared_subscriptions/count", name: "mosquitto_shared_subscriptions", help: "The total number of shared subscriptions active on the broker."},
+
+	// Moving averages
+	{pattern: "$SYS/broker/load/messages/+direction/+interval", name: "mosquitto_load_messages", help: "The moving average of the number of messages received or sent per minute."},
+	{pattern: "$SYS/broker/load/bytes/+direction/+interval", name: "mosquitto_load_bytes", help: "The moving average of the number of bytes received or sent per minute."},
+	{pattern: "$SYS/broker/load/publish/dropped/+interval", name: "mosquitto_load_publish_messages_dropped", help: "The moving average of the number of PUBLISH messages dropped per minute."},
+	{pattern: "$SYS/broker/load/publish/+direction/+interval", name: "mosquitto_load_publish_messages", help: "The moving average of the number of PUBLISH messages received or sent per minute."},
+	{pattern: "$SYS/broker/load/connections/+interval", name: "mosquitto_load_connections", help: "The moving average of the number of CONNECT packets received per minute."},
+	{pattern: "$SYS/broker/load/sockets/+interval", name: "mosquitto_load_sockets", help: "The moving average of the number of socket connections opened per minute."},
+})
+
+// compileStructuredRules splits the rule patterns into topic levels
+func compileStructuredRules(rules []structuredRule) []structuredRule {
+	for i := range rules {
+		rules[i].segments = strings.Split(rules[i].pattern, "/")
+	}
+
+	return rules
+}
+
+// match returns the metric for topic if it matches the rule
+func (r *structuredRule) match(topic string) (topicMetric, bool) {
+	levels := strings.Split(topic, "/")
+	if len(levels) != len(r.segments) {
+		return topicMetric{}, false
+	}
+
+	metric := topicMetric{
+		Name:    r.name,
+		Help:    r.help,
+		Counter: r.counter,
+	}
+
+	for i, segment := range r.segments {
+		if strings.HasPrefix(segment, "+") {
+			metric.LabelNames = append(metric.LabelNames, segment[1:])
+			metric.LabelValues = append(metric.LabelValues, levels[i])
+
+			continue
+		}
+
+		if segment != levels[i] {
+			return topicMetric{}, false
+		}
+	}
+
+	if r.fixed[0] != "" {
+		metric.LabelNames = append(metric.LabelNames, r.fixed[0])
+		metric.LabelValues = append(metric.LabelValues, r.fixed[1])
+	}
+
+	return metric, true
+}
+
+// legacyMetricForTopic flattens the topic into a metric name using parseTopic,
+// adding a _total suffix to counters
+func legacyMetricForTopic(topic string) topicMetric {
+	name := parseTopic(topic)
+
+	help, counter := counterKeyMetrics[topic]
+	if !counter {
+		return topicMetric{Name: name, Help: name}
+	}
+
+	// Add _total suffix to counter names following Prometheus naming conventions
+	if !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+
+	return topicMetric{Name: name, Help: help, Counter: true}
+}
+
+// structuredMetricForTopic looks the topic up in the structured mapping table.
+// Topics without a rule fall back to a flattened, mosquitto_-prefixed name.
+func structuredMetricForTopic(topic string) topicMetric {
+	for i := range structuredRules {
+		if metric, ok := structuredRules[i].match(topic); ok {
+			return metric
+		}
+	}
+
+	metric := legacyMetricForTopic(topic)
+	metric.Name = "mosquitto_" + strings.TrimPrefix(metric.Name, "broker_")
+
+	if !metric.Counter {
+		metric.Help = topic
+	}
+
+	return metric
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probeSettleTime is how long a probe waits without receiving a $SYS message
+// before it considers the cycle complete. Mosquitto publishes its $SYS tree as
+// retained messages, so the full tree arrives in a burst right after subscribing.
+const probeSettleTime = 500 * time.Millisecond
+
+// scrapeTimeoutOffset is subtracted from Prometheus' scrape timeout so the
+// probe can respond before Prometheus gives up on the request
+const scrapeTimeoutOffset = 500 * time.Millisecond
+
+// ProbeHandler serves blackbox-style /probe requests, scraping the target
+// broker once per request
+type ProbeHandler struct {
+	config *ProbeConfig
+	naming string
+}
+
+// NewProbeHandler creates a new probe handler exporting metrics under the given naming mode
+func NewProbeHandler(cfg *ProbeConfig, naming string) *ProbeHandler {
+	return &ProbeHandler{
+		config: cfg,
+		naming: naming,
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (ph *ProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	if !strings.Contains(target, "://") {
+		target = "tcp://" + target
+	}
+
+	if err := validateEndpoint(target); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	moduleName := r.URL.Query().Get("module")
+	if moduleName == "" {
+		moduleName = "default"
+	}
+
+	module, ok := ph.config.Modules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	timeout := probeTimeout(r, module.Timeout.Duration)
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	registry := prometheus.NewRegistry()
+
+	probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Whether the probe of the broker succeeded (1 = success, 0 = failure)",
+	})
+	probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "How long the probe took to complete in seconds",
+	})
+	registry.MustRegister(probeSuccess, probeDuration)
+
+	start := time.Now()
+
+	if err := probeBroker(ctx, module.BrokerConfig(target), NewProbeMetrics(registry, ph.naming)); err != nil {
+		slog.Warn("Probe failed", "target", target, "module", moduleName, "error", err)
+	} else {
+		probeSuccess.Set(1)
+	}
+
+	probeDuration.Set(time.Since(start).Seconds())
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// probeTimeout returns the module timeout, shortened to fit within the
+// scrape timeout Prometheus advertises in its request headers
+func probeTimeout(r *http.Request, timeout time.Duration) time.Duration {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return timeout
+	}
+
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		return timeout
+	}
+
+	scrapeTimeout := time.Duration(seconds*float64(time.Second)) - scrapeTimeoutOffset
+	if scrapeTimeout > 0 && scrapeTimeout < timeout {
+		return scrapeTimeout
+	}
+
+	return timeout
+}
+
+// probeBroker connects to the broker, collects one $SYS cycle into metrics
+// and disconnects. It returns an error if the broker could not be reached or
+// sent no $SYS messages before ctx expired.
+func probeBroker(ctx context.Context, cfg *BrokerConfig, metrics *MosquittoMetrics) error {
+	// Concurrent probes with the same module would take each other over
+	if cfg.ClientID != "" {
+		suffix := make([]byte, 4)
+		_, _ = rand.Read(suffix)
+		cfg.ClientID += "-" + hex.EncodeToString(suffix)
+	}
+
+	bc := newBrokerConnection(cfg, &MosquittoConfig{}, metrics)
+
+	opts, err := bc.clientOptions()
+	if err != nil {
+		return err
+	}
+
+	// The probe manages its own single connection attempt and subscription
+	opts.OnConnect = nil
+	opts.OnConnectionLost = nil
+	opts.SetAutoReconnect(false)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		opts.SetConnectTimeout(time.Until(deadline))
+	}
+
+	client := bc.newClient(opts)
+	connect := client.Connect()
+
+	defer disconnectAfter(client, connect, 0)
+
+	if err := waitToken(ctx, connect); err != nil {
+		metrics.SetBrokerConnected(bc.labelValues, false)
+		return fmt.Errorf("connect: %w", err)
+	}
+
+	metrics.SetBrokerConnected(bc.labelValues, true)
+
+	received := make(chan struct{}, 1)
+	handler := func(client mqtt.Client, msg mqtt.Message) {
+		bc.messageHandler(client, msg)
+
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+	}
+
+	if err := waitToken(ctx, client.Subscribe("$SYS/#", 0, handler)); err != nil {
+		return fmt.Errorf("subscribe to $SYS/#: %w", err)
+	}
+
+	// Wait for the first message, then until the broker goes quiet
+	select {
+	case <-received:
+	case <-ctx.Done():
+		return fmt.Errorf("no $SYS messages received: %w", ctx.Err())
+	}
+
+	settle := time.NewTimer(probeSettleTime)
+	defer settle.Stop()
+
+	for {
+		select {
+		case <-received:
+			settle.Reset(probeSettleTime)
+		case <-settle.C:
+			return nil
+		case <-ctx.Done():
+			// The broker kept publishing until the deadline; what we have is complete enough
+			return nil
+		}
+	}
+}
+
+// waitToken waits for an MQTT token to complete or ctx to expire
+func waitToken(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// disconnectAfter closes client once its connection attempt has finished.
+// Disconnect doesn't stop an attempt in progress: the v3 client lets it
+// complete after Disconnect has returned and only then closes the connection.
+// The attempt is bounded by the client's connect timeout.
+func disconnectAfter(client mqtt.Client, connect mqtt.Token, quiesce uint) {
+	connect.Wait()
+	client.Disconnect(quiesce)
+}
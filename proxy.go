@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/proxy"
+)
+
+// Validate checks that the proxy URL can be used to reach a broker
+func (p *ProxyConfig) Validate() error {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "socks5" {
+		return fmt.Errorf("unsupported proxy scheme %q: use http:// for an HTTP CONNECT proxy or socks5:// for a SOCKS5 proxy", u.Scheme)
+	}
+
+	if u.Hostname() == "" || u.Port() == "" {
+		return fmt.Errorf("url %q must include a host and port", p.URL)
+	}
+
+	return nil
+}
+
+// proxyURL returns the proxy URL with the configured credentials, which
+// take precedence over any in the URL itself
+func (p *ProxyConfig) proxyURL() (*url.URL, error) {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Username != "" {
+		u.User = url.UserPassword(p.Username, p.Password.Value())
+	}
+
+	return u, nil
+}
+
+// redactProxyURL returns the proxy URL with any password replaced, for display
+func redactProxyURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	return u.Redacted()
+}
+
+// proxyDialer opens broker connections through an HTTP CONNECT or SOCKS5
+// proxy. The MQTT client only takes proxies from the environment, and not
+// at all for TLS endpoints unless all_proxy is set.
+type proxyDialer struct {
+	proxy   *url.URL
+	forward *net.Dialer
+}
+
+// newProxyDialer creates a dialer for the configured proxy
+func newProxyDialer(cfg *ProxyConfig) (*proxyDialer, error) {
+	u, err := cfg.proxyURL()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyDialer{proxy: u, forward: &net.Dialer{}}, nil
+}
+
+// WebsocketOptions returns the options that route WebSocket connections
+// through the proxy
+func (pd *proxyDialer) WebsocketOptions() *mqtt.WebsocketOptions {
+	return &mqtt.WebsocketOptions{Proxy: http.ProxyURL(pd.proxy)}
+}
+
+// OpenConnection opens the network connection for the MQTT client, see
+// mqtt.OpenConnectionFunc
+func (pd *proxyDialer) OpenConnection(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+	if isWebSocketEndpoint(uri) {
+		return openWebSocket(uri, options)
+	}
+
+	ctx, cancel := connectContext(options)
+	defer cancel()
+
+	conn, err := pd.DialContext(ctx, "tcp", uri.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(tlsSchemes, uri.Scheme) {
+		return conn, nil
+	}
+
+	return startTLS(ctx, conn, uri, options)
+}
+
+// DialContext connects to addr through the proxy
+func (pd *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch pd.proxy.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if pd.proxy.User != nil {
+			password, _ := pd.proxy.User.Password()
+			auth = &proxy.Auth{User: pd.proxy.User.Username(), Password: password}
+		}
+
+		dialer, err := proxy.SOCKS5("tcp", pd.proxy.Host, auth, pd.forward)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("socks5 proxy %s: %w", pd.proxy.Host, err)
+		}
+
+		return conn, nil
+	case "http":
+		return pd.dialConnect(ctx, addr)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", pd.proxy.Scheme)
+	}
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request
+func (pd *proxyDialer) dialConnect(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := pd.forward.DialContext(ctx, "tcp", pd.proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("http proxy %s: %w", pd.proxy.Host, err)
+	}
+
+	// Interrupt the handshake when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if pd.proxy.User != nil {
+		password, _ := pd.proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(pd.proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %w", pd.proxy.Host, errors.Join(err, ctx.Err()))
+	}
+
+	reader := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %w", pd.proxy.Host, errors.Join(err, ctx.Err()))
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy %s refused CONNECT to %s: %s", pd.proxy.Host, addr, resp.Status)
+	}
+
+	if !stop() {
+		// ctx expired just as the tunnel was established and conn is closed
+		return nil, ctx.Err()
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a connection with data already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads from the buffer before the connection
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.reader.Read(p)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// uptimeTopic is published every sys_interval with the broker's uptime in seconds
+const uptimeTopic = "$SYS/broker/uptime"
+
+// restartCounterTopics are counters that only decrease when the broker restarts
+var restartCounterTopics = map[string]bool{
+	"$SYS/broker/bytes/received": true,
+	"$SYS/broker/bytes/sent":     true,
+}
+
+// restartDetector tracks a broker's uptime and byte counters to detect
+// restarts and estimate when the broker started. State is kept across
+// reconnects, so a restart while the exporter was disconnected is detected
+// from the first values received afterwards.
+type restartDetector struct {
+	mu        sync.Mutex
+	uptime    float64
+	hasUptime bool
+	counters  map[string]float64
+	startTime time.Time
+}
+
+// newRestartDetector creates a detector with no knowledge of the broker
+func newRestartDetector() *restartDetector {
+	return &restartDetector{
+		counters: make(map[string]float64),
+	}
+}
+
+// Uptime records an uptime value received at now. It reports whether the
+// uptime went backwards, and the estimated start time if it changed.
+//
+// $SYS values are retained, so the first uptime after connecting may be up
+// to a sys_interval old, which makes the broker appear to have started later
+// than it did. The earliest estimate since the last restart is kept.
+func (rd *restartDetector) Uptime(uptime float64, now time.Time) (restarted bool, startTime time.Time, changed bool) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if rd.hasUptime && uptime < rd.uptime {
+		rd.reset()
+		restarted = true
+	}
+
+	rd.uptime = uptime
+	rd.hasUptime = true
+
+	estimate := now.Add(-time.Duration(uptime * float64(time.Second)))
+	if rd.startTime.IsZero() || estimate.Before(rd.startTime) {
+		rd.startTime = estimate
+		changed = true
+	}
+
+	return restarted, rd.startTime, changed
+}
+
+// Counter records a value of one of restartCounterTopics and reports whether
+// it decreased. The start time is unknown until the next uptime value.
+func (rd *restartDetector) Counter(topic string, value float64) bool {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	previous, ok := rd.counters[topic]
+	if ok && value < previous {
+		rd.reset()
+		rd.counters[topic] = value
+
+		return true
+	}
+
+	rd.counters[topic] = value
+
+	return false
+}
+
+// reset forgets all values from before a restart, so the restart isn't
+// counted again when the remaining values arrive. Must be called with rd.mu held.
+func (rd *restartDetector) reset() {
+	rd.hasUptime = false
+	rd.startTime = time.Time{}
+
+	clear(rd.counters)
+}
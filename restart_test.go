@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartDetectorUptime(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+
+	type sample struct {
+		uptime        float64
+		at            time.Duration
+		wantRestarted bool
+		wantChanged   bool
+		wantStart     time.Duration
+	}
+
+	tests := []struct {
+		name    string
+		samples []sample
+	}{
+		{
+			name: "first sample",
+			samples: []sample{
+				{uptime: 100, at: 0, wantChanged: true, wantStart: -100 * time.Second},
+			},
+		},
+		{
+			name: "monotonic uptime keeps the start time",
+			samples: []sample{
+				{uptime: 100, at: 0, wantChanged: true, wantStart: -100 * time.Second},
+				{uptime: 110, at: 10 * time.Second, wantStart: -100 * time.Second},
+				{uptime: 120, at: 20 * time.Second, wantStart: -100 * time.Second},
+			},
+		},
+		{
+			name: "equal uptime isn't a restart",
+			samples: []sample{
+				{uptime: 100, at: 0, wantChanged: true, wantStart: -100 * time.Second},
+				{uptime: 100, at: 10 * time.Second, wantStart: -100 * time.Second},
+			},
+		},
+		{
+			name: "stale retained uptime is corrected by a later one",
+			samples: []sample{
+				{uptime: 100, at: 0, wantChanged: true, wantStart: -100 * time.Second},
+				{uptime: 115, at: 10 * time.Second, wantChanged: true, wantStart: -105 * time.Second},
+			},
+		},
+		{
+			name: "uptime going backwards is a restart",
+			samples: []sample{
+				{uptime: 100, at: 0, wantChanged: true, wantStart: -100 * time.Second},
+				{uptime: 5, at: 10 * time.Second, wantRestarted: true, wantChanged: true, wantStart: 5 * time.Second},
+				{uptime: 15, at: 20 * time.Second, wantStart: 5 * time.Second},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd := newRestartDetector()
+
+			for i, s := range tt.samples {
+				restarted, start, changed := rd.Uptime(s.uptime, base.Add(s.at))
+				if restarted != s.wantRestarted || changed != s.wantChanged || !start.Equal(base.Add(s.wantStart)) {
+					t.Errorf("sample %d: Uptime(%g) = %t, %s, %t; want %t, %s, %t", i, s.uptime,
+						restarted, start, changed, s.wantRestarted, base.Add(s.wantStart), s.wantChanged)
+				}
+			}
+		})
+	}
+}
+
+func TestRestartDetectorCounter(t *testing.T) {
+	const received, sent = "$SYS/broker/bytes/received", "$SYS/broker/bytes/sent"
+
+	type sample struct {
+		topic         string
+		value         float64
+		wantRestarted bool
+	}
+
+	tests := []struct {
+		name    string
+		samples []sample
+	}{
+		{
+			name:    "first sample",
+			samples: []sample{{topic: received, value: 100}},
+		},
+		{
+			name: "monotonic and equal values",
+			samples: []sample{
+				{topic: received, value: 100},
+				{topic: received, value: 100},
+				{topic: received, value: 200},
+			},
+		},
+		{
+			name: "decrease is a restart",
+			samples: []sample{
+				{topic: received, value: 100},
+				{topic: received, value: 10, wantRestarted: true},
+				{topic: received, value: 20},
+			},
+		},
+		{
+			name: "counters are tracked separately",
+			samples: []sample{
+				{topic: received, value: 100},
+				{topic: sent, value: 50},
+				{topic: sent, value: 60},
+			},
+		},
+		{
+			name: "a restart is only counted once",
+			samples: []sample{
+				{topic: received, value: 100},
+				{topic: sent, value: 200},
+				{topic: received, value: 10, wantRestarted: true},
+				{topic: sent, value: 20},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd := newRestartDetector()
+
+			for i, s := range tt.samples {
+				if got := rd.Counter(s.topic, s.value); got != s.wantRestarted {
+					t.Errorf("sample %d: Counter(%s, %g) = %t, want %t", i, s.topic, s.value, got, s.wantRestarted)
+				}
+			}
+		})
+	}
+}
+
+func TestRestartDetectorCounterResetsUptime(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	rd := newRestartDetector()
+
+	rd.Uptime(100, base)
+	rd.Counter("$SYS/broker/bytes/received", 100)
+
+	if !rd.Counter("$SYS/broker/bytes/received", 10) {
+		t.Fatal("counter decrease not detected as a restart")
+	}
+
+	// The lower uptime after the restart was already counted by the counter
+	restarted, start, changed := rd.Uptime(5, base.Add(10*time.Second))
+	if restarted || !changed || !start.Equal(base.Add(5*time.Second)) {
+		t.Errorf("Uptime after counter restart = %t, %s, %t; want false, %s, true", restarted, start, changed, base.Add(5*time.Second))
+	}
+}
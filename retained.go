@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// retainedSettleTime is how long a census waits for further retained
+// messages. The broker sends them in a burst right after subscribing.
+const retainedSettleTime = 2 * time.Second
+
+// Retained message census metric names
+const (
+	retainedMessagesMetricName = "mosquitto_retained_census_messages"
+	retainedMessagesMetricHelp = "Number of retained messages found by the last census, by topic prefix"
+	retainedBytesMetricName    = "mosquitto_retained_census_bytes"
+	retainedBytesMetricHelp    = "Total payload bytes of the retained messages found by the last census, by topic prefix"
+	retainedAgeMetricName      = "mosquitto_retained_census_age_seconds"
+	retainedAgeMetricHelp      = "Age of the retained messages found by the last census, from the timestamp in their payload, by topic prefix"
+	retainedUndatedMetricName  = "mosquitto_retained_census_undated"
+	retainedUndatedMetricHelp  = "Number of retained messages found by the last census without a timestamp in their payload, by topic prefix"
+)
+
+// retainedInventory is what /retained reports for a broker: the last
+// successful census, and the error of the last census if it failed
+type retainedInventory struct {
+	Broker    string          `json:"broker"`
+	Census    *retainedCensus `json:"census"`
+	LastError *censusError    `json:"last_error,omitempty"`
+}
+
+// censusError is why a census failed
+type censusError struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// retainedCensus is the result of counting the retained messages of a broker
+type retainedCensus struct {
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_seconds"`
+	// Complete is false if the census timed out while messages were still arriving
+	Complete bool              `json:"complete"`
+	Messages int               `json:"messages"`
+	Bytes    int               `json:"bytes"`
+	Prefixes []*retainedPrefix `json:"prefixes"`
+
+	// ageBounds are the upper bounds of the age buckets in seconds, if ages are recorded
+	ageBounds []float64
+}
+
+// retainedPrefix are the retained messages on the topics of a prefix
+type retainedPrefix struct {
+	Prefix   string `json:"prefix"`
+	Messages int    `json:"messages"`
+	Bytes    int    `json:"bytes"`
+
+	// Ages counts the messages with a timestamp by age; Undated those
+	// without one. Both are only set if a timestamp field is configured.
+	Ages    []retainedAgeBucket `json:"ages,omitempty"`
+	Undated int                 `json:"undated,omitempty"`
+
+	// Oldest is the timestamp of the oldest message and OldestTopic its topic
+	Oldest      *time.Time `json:"oldest,omitempty"`
+	OldestTopic string     `json:"oldest_topic,omitempty"`
+
+	// ageCounts has a count per age bucket and one for older messages
+	ageCounts []uint64
+	ageSum    float64
+}
+
+// retainedAgeBucket is the number of messages up to an age, and older than
+// the previous bucket's
+type retainedAgeBucket struct {
+	MaxAge   string `json:"max_age"`
+	Messages uint64 `json:"messages"`
+}
+
+// retainedTally aggregates the retained messages received during a census
+type retainedTally struct {
+	cfg      *RetainedConfig
+	selector []selectorStep
+	now      time.Time
+
+	// topics are the topics counted, as overlapping subscriptions may
+	// deliver a message more than once
+	topics   map[string]bool
+	prefixes map[string]*retainedPrefix
+	census   retainedCensus
+}
+
+// newRetainedTally creates an empty tally of a census started at now
+func newRetainedTally(cfg *RetainedConfig, now time.Time) *retainedTally {
+	// validateConfig already rejected invalid selectors
+	selector, _ := parseSelector(cfg.TimestampField)
+
+	tally := &retainedTally{
+		cfg:      cfg,
+		selector: selector,
+		now:      now,
+		topics:   make(map[string]bool),
+		prefixes: make(map[string]*retainedPrefix),
+		census:   retainedCensus{Time: now},
+	}
+
+	if selector != nil {
+		for _, bucket := range cfg.AgeBuckets {
+			tally.census.ageBounds = append(tally.census.ageBounds, bucket.Duration.Seconds())
+		}
+	}
+
+	return tally
+}
+
+// Add counts a retained message
+func (t *retainedTally) Add(topic string, payload []byte) {
+	if t.topics[topic] {
+		return
+	}
+
+	t.topics[topic] = true
+
+	prefix := t.prefix(topicPrefix(topic, t.cfg.PrefixDepth))
+	prefix.Messages++
+	prefix.Bytes += len(payload)
+	t.census.Messages++
+	t.census.Bytes += len(payload)
+
+	if t.selector == nil {
+		return
+	}
+
+	node, err := (&jsonPayload{raw: payload}).Select(t.selector)
+	if err != nil {
+		prefix.Undated++
+		return
+	}
+
+	timestamp, ok := parseTimestamp(node)
+	if !ok {
+		prefix.Undated++
+		return
+	}
+
+	// Clocks of devices may be ahead of ours
+	age := max(t.now.Sub(timestamp).Seconds(), 0)
+	bucket, _ := slices.BinarySearch(t.census.ageBounds, age)
+	prefix.ageCounts[bucket]++
+	prefix.ageSum += age
+
+	if prefix.Oldest == nil || timestamp.Before(*prefix.Oldest) {
+		prefix.Oldest = &timestamp
+		prefix.OldestTopic = topic
+	}
+}
+
+// prefix returns the totals of a prefix, or of "other" once the tally has
+// the maximum number of prefixes
+func (t *retainedTally) prefix(name string) *retainedPrefix {
+	if prefix, ok := t.prefixes[name]; ok {
+		return prefix
+	}
+
+	// Keep a slot for other; a topic prefix of that name shares it
+	if len(t.prefixes) >= t.cfg.MaxPrefixes-1 {
+		name = trafficOtherPrefix
+		if prefix, ok := t.prefixes[name]; ok {
+			return prefix
+		}
+	}
+
+	prefix := &retainedPrefix{Prefix: name}
+	if t.census.ageBounds != nil {
+		prefix.ageCounts = make([]uint64, len(t.census.ageBounds)+1)
+	}
+
+	t.prefixes[name] = prefix
+
+	return prefix
+}
+
+// Census returns the result of the tally
+func (t *retainedTally) Census(complete bool) *retainedCensus {
+	census := t.census
+	census.Duration = time.Since(t.now).Seconds()
+	census.Complete = complete
+	census.Prefixes = make([]*retainedPrefix, 0, len(t.prefixes))
+
+	for _, prefix := range t.prefixes {
+		if prefix.ageCounts != nil {
+			for i, count := range prefix.ageCounts {
+				maxAge := "+Inf"
+				if i < len(t.cfg.AgeBuckets) {
+					maxAge = t.cfg.AgeBuckets[i].Duration.String()
+				}
+
+				prefix.Ages = append(prefix.Ages, retainedAgeBucket{MaxAge: maxAge, Messages: count})
+			}
+		}
+
+		census.Prefixes = append(census.Prefixes, prefix)
+	}
+
+	slices.SortFunc(census.Prefixes, func(a, b *retainedPrefix) int {
+		return strings.Compare(a.Prefix, b.Prefix)
+	})
+
+	return &census
+}
+
+// parseTimestamp interprets a JSON value as a point in time: Unix seconds or
+// milliseconds, as a number or string, or an RFC 3339 string
+func parseTimestamp(value any) (time.Time, bool) {
+	switch v := value.(type) {
+	case float64:
+		return unixTime(v), true
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return unixTime(n), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// unixTime converts Unix seconds to a time. Values that would be beyond the
+// year 5000 in seconds are taken as milliseconds.
+func unixTime(value float64) time.Time {
+	if value > 1e11 {
+		value /= 1000
+	}
+
+	seconds, fraction := math.Modf(value)
+
+	return time.Unix(int64(seconds), int64(fraction*1e9))
+}
+
+// runRetainedCensus takes a census of the broker's retained messages every
+// interval until the broker connection is stopped
+func (bc *brokerConnection) runRetainedCensus() {
+	ticker := time.NewTicker(bc.settings.Retained.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		bc.recordRetainedCensus()
+
+		select {
+		case <-bc.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordRetainedCensus takes a census and exports its result
+func (bc *brokerConnection) recordRetainedCensus() {
+	inventory := &retainedInventory{Broker: bc.config.Name}
+	if previous := bc.retained.Load(); previous != nil {
+		inventory.Census = previous.Census
+	}
+
+	census, err := bc.takeRetainedCensus(bc.ctx)
+	if err != nil {
+		// Stopping the exporter isn't a failure
+		if bc.ctx.Err() != nil {
+			return
+		}
+
+		slog.Warn("Retained message census failed", "broker", bc.config.Name, "error", err)
+		bc.metrics.IncRetainedCensusFailure(bc.labelValues)
+
+		inventory.LastError = &censusError{Message: err.Error(), Time: time.Now()}
+		bc.retained.Store(inventory)
+
+		return
+	}
+
+	slog.Debug("Retained message census taken",
+		"broker", bc.config.Name,
+		"messages", census.Messages,
+		"bytes", census.Bytes,
+		"prefixes", len(census.Prefixes),
+		"complete", census.Complete,
+	)
+
+	inventory.Census = census
+	bc.retained.Store(inventory)
+	bc.metrics.SetRetainedCensus(bc.labelValues, census)
+}
+
+// takeRetainedCensus subscribes to the configured topics with a separate
+// client and counts the retained messages the broker sends, until it goes
+// quiet or the census times out
+func (bc *brokerConnection) takeRetainedCensus(ctx context.Context) (*retainedCensus, error) {
+	cfg := &bc.settings.Retained
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout.Duration)
+	defer cancel()
+
+	tally := newRetainedTally(cfg, time.Now())
+
+	client, err := bc.newAuxiliaryClient("retained", cfg.Timeout.Duration)
+	if err != nil {
+		return nil, err
+	}
+
+	connect := client.Connect()
+	defer disconnectAfter(client, connect, 0)
+
+	if err := waitToken(ctx, connect); err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+
+	var mu sync.Mutex
+
+	received := make(chan struct{}, 1)
+	handler := func(_ mqtt.Client, msg mqtt.Message) {
+		// Only messages published while subscribed lack the retain flag
+		if !msg.Retained() {
+			return
+		}
+
+		mu.Lock()
+		tally.Add(msg.Topic(), msg.Payload())
+		mu.Unlock()
+
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+	}
+
+	filters := make(map[string]byte, len(cfg.Topics))
+	for _, filter := range cfg.Topics {
+		filters[filter] = 0
+	}
+
+	if err := waitToken(ctx, client.SubscribeMultiple(minimalSubscriptions(filters), handler)); err != nil {
+		return nil, fmt.Errorf("subscribe: %w", err)
+	}
+
+	settle := time.NewTimer(retainedSettleTime)
+	defer settle.Stop()
+
+	complete := false
+
+wait:
+	for {
+		select {
+		case <-received:
+			settle.Reset(retainedSettleTime)
+		case <-settle.C:
+			complete = true
+			break wait
+		case <-ctx.Done():
+			// The census of a large inventory is still useful when cut short
+			break wait
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	return tally.Census(complete), nil
+}
+
+// RetainedInventory returns the last census of the broker's retained messages
+func (bc *brokerConnection) RetainedInventory() retainedInventory {
+	if inventory := bc.retained.Load(); inventory != nil {
+		return *inventory
+	}
+
+	return retainedInventory{Broker: bc.config.Name}
+}
+
+// retainedCollector exports the last retained message census of all brokers
+type retainedCollector struct {
+	messages *prometheus.Desc
+	bytes    *prometheus.Desc
+	ages     *prometheus.Desc
+	undated  *prometheus.Desc
+
+	mu       sync.RWMutex
+	censuses map[string]brokerRetainedCensus
+}
+
+// brokerRetainedCensus is the last census of a broker
+type brokerRetainedCensus struct {
+	labelValues []string
+	census      *retainedCensus
+}
+
+// newRetainedCollector creates a collector for censuses of brokers with the given label names
+func newRetainedCollector(labelNames []string) *retainedCollector {
+	prefixLabelNames := append(append([]string{}, labelNames...), "prefix")
+
+	return &retainedCollector{
+		messages: prometheus.NewDesc(retainedMessagesMetricName, retainedMessagesMetricHelp, prefixLabelNames, nil),
+		bytes:    prometheus.NewDesc(retainedBytesMetricName, retainedBytesMetricHelp, prefixLabelNames, nil),
+		ages:     prometheus.NewDesc(retainedAgeMetricName, retainedAgeMetricHelp, prefixLabelNames, nil),
+		undated:  prometheus.NewDesc(retainedUndatedMetricName, retainedUndatedMetricHelp, prefixLabelNames, nil),
+		censuses: make(map[string]brokerRetainedCensus),
+	}
+}
+
+// Set replaces the census of a broker
+func (rc *retainedCollector) Set(labelValues []string, census *retainedCensus) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.censuses[labelValues[0]] = brokerRetainedCensus{labelValues: labelValues, census: census}
+}
+
+// Describe implements prometheus.Collector
+func (rc *retainedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rc.messages
+	ch <- rc.bytes
+	ch <- rc.ages
+	ch <- rc.undated
+}
+
+// Collect implements prometheus.Collector
+func (rc *retainedCollector) Collect(ch chan<- prometheus.Metric) {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+
+	for _, broker := range rc.censuses {
+		census := broker.census
+
+		for _, prefix := range census.Prefixes {
+			values := append(append([]string{}, broker.labelValues...), prefix.Prefix)
+			ch <- prometheus.MustNewConstMetric(rc.messages, prometheus.GaugeValue, float64(prefix.Messages), values...)
+			ch <- prometheus.MustNewConstMetric(rc.bytes, prometheus.GaugeValue, float64(prefix.Bytes), values...)
+
+			if census.ageBounds == nil {
+				continue
+			}
+
+			buckets := make(map[float64]uint64, len(census.ageBounds))
+
+			var count uint64
+
+			for i, bound := range census.ageBounds {
+				count += prefix.ageCounts[i]
+				buckets[bound] = count
+			}
+
+			count += prefix.ageCounts[len(census.ageBounds)]
+			ch <- prometheus.MustNewConstHistogram(rc.ages, count, prefix.ageSum, buckets, values...)
+			ch <- prometheus.MustNewConstMetric(rc.undated, prometheus.GaugeValue, float64(prefix.Undated), values...)
+		}
+	}
+}
+
+// RetainedHandler serves the last retained message census of every broker
+// as JSON, or of the broker given by the "broker" query parameter
+type RetainedHandler struct {
+	inventories func() []retainedInventory
+}
+
+// NewRetainedHandler creates a handler reporting the given inventories
+func NewRetainedHandler(inventories func() []retainedInventory) *RetainedHandler {
+	return &RetainedHandler{inventories: inventories}
+}
+
+// ServeHTTP implements http.Handler
+func (rh *RetainedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	inventories := rh.inventories()
+
+	if broker := r.URL.Query().Get("broker"); broker != "" {
+		inventories = slices.DeleteFunc(inventories, func(inventory retainedInventory) bool {
+			return inventory.Broker != broker
+		})
+
+		if len(inventories) == 0 {
+			http.Error(w, fmt.Sprintf("unknown broker %q", broker), http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	_ = json.NewEncoder(w).Encode(struct {
+		Timestamp int64               `json:"timestamp"`
+		Brokers   []retainedInventory `json:"brokers"`
+	}{time.Now().Unix(), inventories})
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Round-trip probe results
+const (
+	roundTripSuccess = "success"
+	roundTripTimeout = "timeout"
+	roundTripError   = "error"
+)
+
+// Round-trip in-flight metric name
+const (
+	roundTripInFlightMetricName = "mosquitto_roundtrip_in_flight_seconds"
+	roundTripInFlightMetricHelp = "Time the oldest round-trip probe message still awaiting delivery has been in flight, by QoS (0 if none)"
+)
+
+// roundTripPayload is the payload of a probe message
+type roundTripPayload struct {
+	ID   string    `json:"id"`
+	QoS  byte      `json:"qos"`
+	Sent time.Time `json:"sent"`
+}
+
+// roundTripMessage is a probe message awaiting delivery
+type roundTripMessage struct {
+	qos      byte
+	sent     time.Time
+	received chan time.Time
+}
+
+// roundTripProber periodically publishes a message at every configured QoS
+// to the probe topic with a separate client, and measures how long the
+// broker takes to deliver it back on the client's own subscription
+type roundTripProber struct {
+	bc  *brokerConnection
+	cfg *RoundTripConfig
+
+	// nonce tells our messages from those of other exporters using the topic
+	nonce string
+	seq   atomic.Uint64
+
+	mu      sync.Mutex
+	pending map[string]*roundTripMessage
+
+	// client is only used by Run
+	client mqtt.Client
+}
+
+// newRoundTripProber creates a prober for a broker
+func newRoundTripProber(bc *brokerConnection, cfg *RoundTripConfig) *roundTripProber {
+	nonce := make([]byte, 8)
+	_, _ = rand.Read(nonce)
+
+	return &roundTripProber{
+		bc:      bc,
+		cfg:     cfg,
+		nonce:   hex.EncodeToString(nonce),
+		pending: make(map[string]*roundTripMessage),
+	}
+}
+
+// Run probes every interval until ctx is done
+func (p *roundTripProber) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.Interval.Duration)
+	defer ticker.Stop()
+
+	defer func() {
+		if p.client != nil {
+			p.client.Disconnect(250)
+		}
+	}()
+
+	for {
+		p.probe(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe sends a message at every configured QoS and waits for their delivery
+func (p *roundTripProber) probe(ctx context.Context) {
+	if err := p.ensureConnected(ctx); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+
+		slog.Warn("Round-trip probe failed to connect", "broker", p.bc.config.Name, "error", err)
+
+		for _, qos := range p.cfg.QoS {
+			p.bc.metrics.RecordRoundTrip(p.bc.labelValues, qos, roundTripError, 0)
+		}
+
+		return
+	}
+
+	var wg sync.WaitGroup
+
+	for _, qos := range p.cfg.QoS {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			p.probeQoS(ctx, byte(qos)) //nolint:gosec // validated to be 0-2
+		}()
+	}
+
+	wg.Wait()
+}
+
+// probeQoS sends a message at the given QoS and waits for its delivery
+func (p *roundTripProber) probeQoS(ctx context.Context, qos byte) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout.Duration)
+	defer cancel()
+
+	id := p.nonce + "-" + strconv.FormatUint(p.seq.Add(1), 10)
+	msg := &roundTripMessage{qos: qos, sent: time.Now(), received: make(chan time.Time, 1)}
+
+	p.mu.Lock()
+	p.pending[id] = msg
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}()
+
+	payload, err := json.Marshal(roundTripPayload{ID: id, QoS: qos, Sent: msg.sent})
+	if err != nil {
+		return
+	}
+
+	result, latency := roundTripTimeout, time.Duration(0)
+
+	if err := waitToken(ctx, p.client.Publish(p.cfg.Topic, qos, false, payload)); err != nil {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			result = roundTripError
+
+			slog.Debug("Round-trip probe failed to publish", "broker", p.bc.config.Name, "qos", qos, "error", err)
+		}
+	} else {
+		select {
+		case received := <-msg.received:
+			result, latency = roundTripSuccess, received.Sub(msg.sent)
+		case <-ctx.Done():
+		}
+	}
+
+	// Stopping the exporter isn't a failure
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+
+	p.bc.metrics.RecordRoundTrip(p.bc.labelValues, int(qos), result, latency)
+}
+
+// ensureConnected connects the probe client and subscribes to the probe
+// topic, unless it is still connected
+func (p *roundTripProber) ensureConnected(ctx context.Context) error {
+	if p.client != nil && p.client.IsConnectionOpen() {
+		return nil
+	}
+
+	// Clients don't reconnect on their own, and a new client subscribes again
+	if p.client != nil {
+		p.client.Disconnect(0)
+		p.client = nil
+		p.bc.metrics.SetRoundTripConnected(p.bc.labelValues, false)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout.Duration)
+	defer cancel()
+
+	client, err := p.bc.newAuxiliaryClient("roundtrip", p.cfg.Timeout.Duration)
+	if err != nil {
+		return err
+	}
+
+	connect := client.Connect()
+	if err := waitToken(ctx, connect); err != nil {
+		disconnectAfter(client, connect, 0)
+		return fmt.Errorf("connect: %w", err)
+	}
+
+	// Messages are delivered with the lower of the publish and subscription QoS
+	if err := waitToken(ctx, client.Subscribe(p.cfg.Topic, 2, p.handleMessage)); err != nil {
+		client.Disconnect(0)
+		return fmt.Errorf("subscribe to %s: %w", p.cfg.Topic, err)
+	}
+
+	p.client = client
+	p.bc.metrics.SetRoundTripConnected(p.bc.labelValues, true)
+
+	return nil
+}
+
+// handleMessage records the delivery of a probe message
+func (p *roundTripProber) handleMessage(_ mqtt.Client, msg mqtt.Message) {
+	received := time.Now()
+
+	var payload roundTripPayload
+	if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+		return
+	}
+
+	// Messages of other exporters, or that arrived after timing out
+	p.mu.Lock()
+	pending, ok := p.pending[payload.ID]
+	p.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	// QoS 1 messages may be delivered more than once
+	select {
+	case pending.received <- received:
+	default:
+	}
+}
+
+// inFlight returns how long the oldest message of each QoS has been
+// awaiting delivery
+func (p *roundTripProber) inFlight(now time.Time) map[byte]time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	durations := make(map[byte]time.Duration, len(p.cfg.QoS))
+	for _, msg := range p.pending {
+		durations[msg.qos] = max(durations[msg.qos], now.Sub(msg.sent))
+	}
+
+	return durations
+}
+
+// roundTripCollector exports how long the probe messages of all brokers
+// have been in flight, at scrape time
+type roundTripCollector struct {
+	inFlight *prometheus.Desc
+
+	mu      sync.RWMutex
+	probers []brokerRoundTripProber
+}
+
+// brokerRoundTripProber is the round-trip prober of a broker
+type brokerRoundTripProber struct {
+	labelValues []string
+	prober      *roundTripProber
+}
+
+// newRoundTripCollector creates a collector for probers of brokers with the given label names
+func newRoundTripCollector(labelNames []string) *roundTripCollector {
+	return &roundTripCollector{
+		inFlight: prometheus.NewDesc(roundTripInFlightMetricName, roundTripInFlightMetricHelp,
+			append(append([]string{}, labelNames...), "qos"), nil),
+	}
+}
+
+// Add exports the in-flight durations of a broker's prober
+func (rc *roundTripCollector) Add(labelValues []string, prober *roundTripProber) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.probers = append(rc.probers, brokerRoundTripProber{labelValues: labelValues, prober: prober})
+}
+
+// Describe implements prometheus.Collector
+func (rc *roundTripCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rc.inFlight
+}
+
+// Collect implements prometheus.Collector
+func (rc *roundTripCollector) Collect(ch chan<- prometheus.Metric) {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+
+	now := time.Now()
+
+	for _, broker := range rc.probers {
+		durations := broker.prober.inFlight(now)
+
+		for _, qos := range broker.prober.cfg.QoS {
+			values := append(append([]string{}, broker.labelValues...), strconv.Itoa(qos))
+			ch <- prometheus.MustNewConstMetric(rc.inFlight, prometheus.GaugeValue, durations[byte(qos)].Seconds(), values...) //nolint:gosec // validated to be 0-2
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricStore holds the values of the metric families derived from $SYS
+// topics and topic_metrics rules and exports them as const metrics at scrape
+// time. Families are created on first use; a name is claimed by the first
+// family that uses it, and later values with a different type or label set
+// are dropped rather than registered, so topic names can never collide at
+// registration or scrape time.
+//
+// It is registered as an unchecked collector as the families it exports
+// aren't known up front.
+type metricStore struct {
+	mu       sync.RWMutex
+	families map[string]*storedFamily
+
+	// onNewFamily is called without the lock held when a family is created
+	onNewFamily func(name, help string, labelNames []string)
+}
+
+// storedFamily is a metric family in the store. Reserved names have no desc.
+type storedFamily struct {
+	desc       *prometheus.Desc
+	valueType  prometheus.ValueType
+	labelNames []string
+	series     map[string]*storedSeries
+	conflicted bool
+
+	// application families are set by topic_metrics rules rather than from
+	// $SYS topics, and are left alone by SetCreated, Expire and DeleteAll
+	application bool
+}
+
+// storedSeries is the current value of a single series and when it was last
+// set. Counters may carry the time they started counting from.
+type storedSeries struct {
+	labelValues []string
+	value       float64
+	updated     time.Time
+	created     time.Time
+}
+
+// newMetricStore creates an empty store
+func newMetricStore(onNewFamily func(name, help string, labelNames []string)) *metricStore {
+	return &metricStore{
+		families:    make(map[string]*storedFamily),
+		onNewFamily: onNewFamily,
+	}
+}
+
+// Reserve claims name for a metric exported by another collector, so no
+// topic-derived family can be created with it
+func (ms *metricStore) Reserve(name string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.families[name]; !ok {
+		ms.families[name] = &storedFamily{}
+	}
+}
+
+// Set sets the value of a series derived from a $SYS topic, creating its
+// family if needed. created is the counter's created timestamp, if known. It
+// returns an error if the name is claimed by a family of a different type or
+// label set, or if a counter would be set to a negative value.
+func (ms *metricStore) Set(name, help string, valueType prometheus.ValueType, labelNames, labelValues []string, value float64, created time.Time) error {
+	return ms.set(name, help, valueType, labelNames, labelValues, value, created, false)
+}
+
+// SetApplication sets the value of a series taken from an application topic
+// like Set. Its family can't be claimed by a $SYS family, and vice versa.
+func (ms *metricStore) SetApplication(name, help string, valueType prometheus.ValueType, labelNames, labelValues []string, value float64) error {
+	return ms.set(name, help, valueType, labelNames, labelValues, value, time.Time{}, true)
+}
+
+// set sets the value of a series of a $SYS or application family
+func (ms *metricStore) set(name, help string, valueType prometheus.ValueType, labelNames, labelValues []string, value float64, created time.Time, application bool) error {
+	if valueType == prometheus.CounterValue && value < 0 {
+		return fmt.Errorf("counter %s cannot be negative", name)
+	}
+
+	ms.mu.Lock()
+
+	family, isNew := ms.families[name], false
+	if family == nil {
+		family = &storedFamily{
+			desc:        prometheus.NewDesc(name, help, labelNames, nil),
+			valueType:   valueType,
+			labelNames:  slices.Clone(labelNames),
+			series:      make(map[string]*storedSeries),
+			application: application,
+		}
+		ms.families[name] = family
+		isNew = true
+	}
+
+	if family.desc == nil || family.valueType != valueType || family.application != application || !slices.Equal(family.labelNames, labelNames) {
+		// Only report each conflicting name once
+		warn := !family.conflicted
+		family.conflicted = true
+		ms.mu.Unlock()
+
+		if warn {
+			slog.Warn("Metric name already in use with a different type or labels; dropping values", "metric", name)
+		}
+
+		return fmt.Errorf("metric %s already in use with a different type or labels", name)
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	series, ok := family.series[key]
+	if !ok {
+		series = &storedSeries{labelValues: slices.Clone(labelValues)}
+		family.series[key] = series
+	}
+
+	series.value = value
+	series.updated = time.Now()
+	series.created = created
+
+	ms.mu.Unlock()
+
+	if isNew && ms.onNewFamily != nil {
+		ms.onNewFamily(name, help, labelNames)
+	}
+
+	return nil
+}
+
+// Delete removes all series of the named family whose labels match labels
+func (ms *metricStore) Delete(name string, labels prometheus.Labels) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	family := ms.families[name]
+	if family == nil || family.desc == nil {
+		return
+	}
+
+	for key, series := range family.series {
+		if family.matches(series, labels) {
+			delete(family.series, key)
+		}
+	}
+}
+
+// SetCreated sets the created timestamp of the counter series of every $SYS
+// family whose labels match labels
+func (ms *metricStore) SetCreated(labels prometheus.Labels, created time.Time) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, family := range ms.families {
+		if family.valueType != prometheus.CounterValue || family.application {
+			continue
+		}
+
+		for _, series := range family.series {
+			if family.matches(series, labels) {
+				series.created = created
+			}
+		}
+	}
+}
+
+// Expire removes the series of every $SYS family whose labels match labels
+// and that haven't been updated since before
+func (ms *metricStore) Expire(labels prometheus.Labels, before time.Time) {
+	ms.deleteMatching(labels, func(series *storedSeries) bool {
+		return series.updated.Before(before)
+	})
+}
+
+// DeleteAll removes the series of every $SYS family whose labels match labels
+func (ms *metricStore) DeleteAll(labels prometheus.Labels) {
+	ms.deleteMatching(labels, func(*storedSeries) bool { return true })
+}
+
+// deleteMatching removes the series of every $SYS family whose labels match
+// labels and for which remove returns true
+func (ms *metricStore) deleteMatching(labels prometheus.Labels, remove func(*storedSeries) bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, family := range ms.families {
+		if family.application {
+			continue
+		}
+
+		for key, series := range family.series {
+			if family.matches(series, labels) && remove(series) {
+				delete(family.series, key)
+			}
+		}
+	}
+}
+
+// matches returns true if the series has all of the given label values
+func (sf *storedFamily) matches(series *storedSeries, labels prometheus.Labels) bool {
+	for name, value := range labels {
+		i := slices.Index(sf.labelNames, name)
+		if i < 0 || series.labelValues[i] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Describe sends nothing, making the store an unchecked collector
+func (ms *metricStore) Describe(chan<- *prometheus.Desc) {}
+
+// Collect exports every stored series as a const metric
+func (ms *metricStore) Collect(ch chan<- prometheus.Metric) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	for _, family := range ms.families {
+		for _, series := range family.series {
+			if family.valueType == prometheus.CounterValue && !series.created.IsZero() {
+				ch <- prometheus.MustNewConstMetricWithCreatedTimestamp(family.desc, family.valueType, series.value, series.created, series.labelValues...)
+				continue
+			}
+
+			ch <- prometheus.MustNewConstMetric(family.desc, family.valueType, series.value, series.labelValues...)
+		}
+	}
+}
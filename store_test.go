@@ -0,0 +1,216 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricStoreSetConflicts(t *testing.T) {
+	gauge, counter := prometheus.GaugeValue, prometheus.CounterValue
+
+	tests := []struct {
+		name        string
+		reserve     bool
+		application bool
+		valueType   prometheus.ValueType
+		labelNames  []string
+		wantErr     bool
+	}{
+		{name: "same type and labels", valueType: gauge, labelNames: []string{"broker"}},
+		{name: "different type", valueType: counter, labelNames: []string{"broker"}, wantErr: true},
+		{name: "different labels", valueType: gauge, labelNames: []string{"broker", "topic"}, wantErr: true},
+		{name: "fewer labels", valueType: gauge, labelNames: nil, wantErr: true},
+		{name: "application family", application: true, valueType: gauge, labelNames: []string{"broker"}, wantErr: true},
+		{name: "reserved name", reserve: true, valueType: gauge, labelNames: []string{"broker"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := newMetricStore(nil)
+			if tt.reserve {
+				ms.Reserve("mosquitto_test")
+			} else if err := ms.Set("mosquitto_test", "Test.", gauge, []string{"broker"}, []string{"a"}, 1, time.Time{}); err != nil {
+				t.Fatalf("first Set: %v", err)
+			}
+
+			var err error
+			if tt.application {
+				err = ms.SetApplication("mosquitto_test", "Test.", tt.valueType, tt.labelNames, make([]string, len(tt.labelNames)), 2)
+			} else {
+				err = ms.Set("mosquitto_test", "Test.", tt.valueType, tt.labelNames, make([]string, len(tt.labelNames)), 2, time.Time{})
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set error = %v, want error %t", err, tt.wantErr)
+			}
+
+			// A conflicting value must not replace or join the existing family
+			want := 1
+			switch {
+			case tt.reserve:
+				want = 0
+			case !tt.wantErr:
+				want = 2
+			}
+
+			if got := testutil.CollectAndCount(ms); got != want {
+				t.Errorf("collected %d series, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestMetricStoreNegativeCounter(t *testing.T) {
+	ms := newMetricStore(nil)
+
+	if err := ms.Set("mosquitto_test_total", "Test.", prometheus.CounterValue, nil, nil, -1, time.Time{}); err == nil {
+		t.Error("Set of a negative counter succeeded")
+	}
+
+	if err := ms.Set("mosquitto_test", "Test.", prometheus.GaugeValue, nil, nil, -1, time.Time{}); err != nil {
+		t.Errorf("Set of a negative gauge: %v", err)
+	}
+}
+
+func TestMetricStoreNewFamilyCallback(t *testing.T) {
+	var families []string
+
+	ms := newMetricStore(func(name, _ string, _ []string) {
+		families = append(families, name)
+	})
+
+	_ = ms.Set("mosquitto_a", "A.", prometheus.GaugeValue, []string{"broker"}, []string{"x"}, 1, time.Time{})
+	_ = ms.Set("mosquitto_a", "A.", prometheus.GaugeValue, []string{"broker"}, []string{"y"}, 1, time.Time{})
+	_ = ms.SetApplication("sensor_b", "B.", prometheus.GaugeValue, []string{"broker"}, []string{"x"}, 1)
+	_ = ms.Set("sensor_b", "B.", prometheus.GaugeValue, []string{"broker"}, []string{"x"}, 1, time.Time{})
+
+	if got := strings.Join(families, ","); got != "mosquitto_a,sensor_b" {
+		t.Errorf("new families = %q, want %q", got, "mosquitto_a,sensor_b")
+	}
+}
+
+// newTestStore returns a store with a $SYS gauge and counter and an
+// application gauge for brokers a and b. The series of broker a were last
+// updated an hour ago.
+func newTestStore(t *testing.T) *metricStore {
+	t.Helper()
+
+	ms := newMetricStore(nil)
+
+	for _, broker := range []string{"a", "b"} {
+		labels := []string{broker}
+		for _, err := range []error{
+			ms.Set("mosquitto_clients", "Clients.", prometheus.GaugeValue, []string{"broker"}, labels, 1, time.Time{}),
+			ms.Set("mosquitto_bytes_total", "Bytes.", prometheus.CounterValue, []string{"broker"}, labels, 2, time.Time{}),
+			ms.SetApplication("sensor_celsius", "Temperature.", prometheus.GaugeValue, []string{"broker"}, labels, 3),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, family := range ms.families {
+		for _, series := range family.series {
+			if series.labelValues[0] == "a" {
+				series.updated = series.updated.Add(-time.Hour)
+			}
+		}
+	}
+
+	return ms
+}
+
+func TestMetricStoreDeletion(t *testing.T) {
+	tests := []struct {
+		name   string
+		delete func(ms *metricStore)
+		want   string
+	}{
+		{
+			name:   "expire stale series of a broker",
+			delete: func(ms *metricStore) { ms.Expire(prometheus.Labels{"broker": "a"}, time.Now().Add(-time.Minute)) },
+			want:   "mosquitto_bytes_total{b} mosquitto_clients{b} sensor_celsius{a} sensor_celsius{b}",
+		},
+		{
+			name:   "expire keeps fresh series",
+			delete: func(ms *metricStore) { ms.Expire(prometheus.Labels{"broker": "b"}, time.Now().Add(-time.Minute)) },
+			want:   "mosquitto_bytes_total{a} mosquitto_bytes_total{b} mosquitto_clients{a} mosquitto_clients{b} sensor_celsius{a} sensor_celsius{b}",
+		},
+		{
+			name:   "expire without labels",
+			delete: func(ms *metricStore) { ms.Expire(nil, time.Now().Add(time.Minute)) },
+			want:   "sensor_celsius{a} sensor_celsius{b}",
+		},
+		{
+			name:   "delete all of a broker",
+			delete: func(ms *metricStore) { ms.DeleteAll(prometheus.Labels{"broker": "b"}) },
+			want:   "mosquitto_bytes_total{a} mosquitto_clients{a} sensor_celsius{a} sensor_celsius{b}",
+		},
+		{
+			name:   "delete all of an unknown label",
+			delete: func(ms *metricStore) { ms.DeleteAll(prometheus.Labels{"bridge": "b"}) },
+			want:   "mosquitto_bytes_total{a} mosquitto_bytes_total{b} mosquitto_clients{a} mosquitto_clients{b} sensor_celsius{a} sensor_celsius{b}",
+		},
+		{
+			name:   "delete a family",
+			delete: func(ms *metricStore) { ms.Delete("mosquitto_clients", prometheus.Labels{"broker": "a"}) },
+			want:   "mosquitto_bytes_total{a} mosquitto_bytes_total{b} mosquitto_clients{b} sensor_celsius{a} sensor_celsius{b}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := newTestStore(t)
+			tt.delete(ms)
+
+			if got := storedSeriesNames(ms); got != tt.want {
+				t.Errorf("series = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricStoreSetCreated(t *testing.T) {
+	ms := newTestStore(t)
+	created := time.Unix(1700000000, 0)
+
+	ms.SetCreated(prometheus.Labels{"broker": "a"}, created)
+
+	for name, family := range ms.families {
+		for _, series := range family.series {
+			want := name == "mosquitto_bytes_total" && series.labelValues[0] == "a"
+			if got := series.created.Equal(created); got != want {
+				t.Errorf("%s{%s} created set = %t, want %t", name, series.labelValues[0], got, want)
+			}
+		}
+	}
+
+	// Collecting a counter with a created timestamp must not panic
+	if got := testutil.CollectAndCount(ms, "mosquitto_bytes_total"); got != 2 {
+		t.Errorf("collected %d mosquitto_bytes_total series, want 2", got)
+	}
+}
+
+// storedSeriesNames lists the series in the store as name{broker}, sorted
+func storedSeriesNames(ms *metricStore) string {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var names []string
+
+	for name, family := range ms.families {
+		for _, series := range family.series {
+			names = append(names, name+"{"+series.labelValues[0]+"}")
+		}
+	}
+
+	slices.Sort(names)
+
+	return strings.Join(names, " ")
+}
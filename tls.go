@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// tlsVersions maps the accepted tls.min_version/max_version values to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses a TLS version such as "1.2" or "TLS1.2". An empty
+// version returns 0, leaving the Go default in place.
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+
+	v := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(version)), "TLS")
+	v = strings.TrimSpace(strings.TrimPrefix(v, "V"))
+
+	if parsed, ok := tlsVersions[v]; ok {
+		return parsed, nil
+	}
+
+	return 0, fmt.Errorf("unsupported TLS version %q (use 1.0, 1.1, 1.2 or 1.3)", version)
+}
+
+// parseCipherSuites maps IANA cipher suite names, such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, to their IDs
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// Validate checks the TLS settings that can be checked without reading files
+func (t *TLSConfig) Validate() error {
+	minVersion, err := parseTLSVersion(t.MinVersion)
+	if err != nil {
+		return fmt.Errorf("min_version: %w", err)
+	}
+
+	maxVersion, err := parseTLSVersion(t.MaxVersion)
+	if err != nil {
+		return fmt.Errorf("max_version: %w", err)
+	}
+
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		return fmt.Errorf("min_version %s is greater than max_version %s", t.MinVersion, t.MaxVersion)
+	}
+
+	if _, err := parseCipherSuites(t.CipherSuites); err != nil {
+		return fmt.Errorf("cipher_suites: %w", err)
+	}
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("both cert_file and key_file must be set together")
+	}
+
+	if t.PKCS12File != "" && t.CertFile != "" {
+		return fmt.Errorf("pkcs12_file cannot be combined with cert_file and key_file")
+	}
+
+	if !t.KeyPassword.IsEmpty() && t.KeyPasswordFile != "" {
+		return fmt.Errorf("key_password and key_password_file cannot both be set")
+	}
+
+	return nil
+}
+
+// keyPassword returns the password of the private key or PKCS#12 bundle,
+// reading key_password_file on every call so it can be rotated with the key
+func (t *TLSConfig) keyPassword() (string, error) {
+	if t.KeyPasswordFile == "" {
+		return t.KeyPassword.Value(), nil
+	}
+
+	password, err := os.ReadFile(t.KeyPasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("read key password file: %w", err)
+	}
+
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
+
+// tlsReloadInterval is how often the certificate, key and CA files are
+// checked for changes
+const tlsReloadInterval = 30 * time.Second
+
+// tlsMaterial is the client certificate and CA pool loaded from disk. Either
+// may be nil: no client certificate is sent, and the system roots are used.
+type tlsMaterial struct {
+	certificate *tls.Certificate
+	roots       *x509.CertPool
+}
+
+// loadTLSMaterial reads the client key pair and CA bundle configured in t
+func loadTLSMaterial(t *TLSConfig) (*tlsMaterial, error) {
+	material := &tlsMaterial{}
+
+	if t.CAFile != "" || t.CADir != "" {
+		pool, err := loadCertPool(t.CAFile, t.CADir)
+		if err != nil {
+			return nil, err
+		}
+
+		material.roots = pool
+	}
+
+	if t.CertFile == "" && t.PKCS12File == "" {
+		return material, nil
+	}
+
+	password, err := t.keyPassword()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.PKCS12File != "" {
+		material.certificate, err = loadPKCS12(t.PKCS12File, password)
+		if err != nil {
+			return nil, fmt.Errorf("load client PKCS#12 bundle: %w", err)
+		}
+
+		return material, nil
+	}
+
+	material.certificate, err = loadKeyPair(t.CertFile, t.KeyFile, password)
+	if err != nil {
+		return nil, fmt.Errorf("load client TLS key pair: %w", err)
+	}
+
+	return material, nil
+}
+
+// loadKeyPair loads a PEM certificate and private key. The key may be an
+// encrypted PKCS#8 key, which is decrypted in memory with password.
+func loadKeyPair(certFile, keyFile, password string) (*tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(keyPEM); block != nil && block.Type == "ENCRYPTED PRIVATE KEY" {
+		if password == "" {
+			return nil, errors.New("private key is encrypted; set tls.key_password or tls.key_password_file")
+		}
+
+		key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("decrypt private key: %w", err)
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt private key: %w", err)
+		}
+
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyPair, nil
+}
+
+// loadPKCS12 loads the certificate, private key and any intermediate
+// certificates from a PKCS#12 bundle
+func loadPKCS12(file, password string) (*tls.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate := &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+
+	for _, cert := range chain {
+		certificate.Certificate = append(certificate.Certificate, cert.Raw)
+	}
+
+	return certificate, nil
+}
+
+// equal returns true if both hold the same certificate chain and CA pool
+func (m *tlsMaterial) equal(other *tlsMaterial) bool {
+	if (m.certificate == nil) != (other.certificate == nil) {
+		return false
+	}
+
+	if m.certificate != nil && !slices.EqualFunc(m.certificate.Certificate, other.certificate.Certificate, bytes.Equal) {
+		return false
+	}
+
+	if (m.roots == nil) != (other.roots == nil) {
+		return false
+	}
+
+	return m.roots == nil || m.roots.Equal(other.roots)
+}
+
+// NotAfter returns the expiry of the client certificate, or the zero time if there is none
+func (m *tlsMaterial) NotAfter() time.Time {
+	if m.certificate == nil || m.certificate.Leaf == nil {
+		return time.Time{}
+	}
+
+	return m.certificate.Leaf.NotAfter
+}
+
+// fileStamp identifies a version of a file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// tlsReloader holds the current TLS material for a broker and reloads it
+// when the files it was loaded from change. The tls.Config it creates reads
+// the current material on every handshake, so a reload takes effect on the
+// next connection without rebuilding the MQTT client.
+type tlsReloader struct {
+	config     *TLSConfig
+	serverName string
+
+	// onVerify is called with the broker certificate chain and the result of
+	// verifying it on every handshake, even if verification is disabled
+	onVerify func(chain []*x509.Certificate, err error)
+	// onConnection is called with the state of every established TLS connection
+	onConnection func(state tls.ConnectionState)
+
+	mu       sync.RWMutex
+	material *tlsMaterial
+	stamps   map[string]fileStamp
+}
+
+// newTLSReloader loads the TLS material for t. serverName is the name the
+// broker certificate is verified against.
+func newTLSReloader(t *TLSConfig, serverName string) (*tlsReloader, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+
+	r := &tlsReloader{
+		config:     t,
+		serverName: serverName,
+	}
+
+	stamps := r.fileStamps()
+
+	material, err := loadTLSMaterial(t)
+	if err != nil {
+		return nil, err
+	}
+
+	r.material = material
+	r.stamps = stamps
+
+	return r, nil
+}
+
+// TLSConfig creates the client TLS configuration. Go's built-in verification
+// only supports a fixed CA pool, so the broker certificate is verified in
+// VerifyPeerCertificate against the current pool instead.
+func (r *tlsReloader) TLSConfig() *tls.Config {
+	minVersion, _ := parseTLSVersion(r.config.MinVersion)
+	maxVersion, _ := parseTLSVersion(r.config.MaxVersion)
+	cipherSuites, _ := parseCipherSuites(r.config.CipherSuites)
+
+	return &tls.Config{
+		InsecureSkipVerify:    true, //nolint:gosec // verified in VerifyPeerCertificate unless insecure_skip_verify is set
+		VerifyPeerCertificate: r.verifyPeerCertificate,
+		VerifyConnection:      r.verifyConnection,
+		GetClientCertificate:  r.getClientCertificate,
+		ServerName:            r.config.ServerName,
+		MinVersion:            minVersion,
+		MaxVersion:            maxVersion,
+		CipherSuites:          cipherSuites,
+		NextProtos:            r.config.ALPNProtocols,
+		ClientAuth:            tls.NoClientCert,
+	}
+}
+
+// Material returns the currently loaded TLS material
+func (r *tlsReloader) Material() *tlsMaterial {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.material
+}
+
+// Reload reloads the TLS material if any of its files changed. It reports
+// whether the material changed; on error the previous material is kept and
+// the reload is retried on the next call.
+func (r *tlsReloader) Reload() (bool, error) {
+	stamps := r.fileStamps()
+
+	r.mu.RLock()
+	unchanged := maps.Equal(stamps, r.stamps)
+	r.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	material, err := loadTLSMaterial(r.config)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := !material.equal(r.material)
+	r.material = material
+	r.stamps = stamps
+
+	return changed, nil
+}
+
+// fileStamps returns the current version of every file the material is loaded from
+func (r *tlsReloader) fileStamps() map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+
+	files := []string{r.config.CAFile, r.config.CertFile, r.config.KeyFile, r.config.PKCS12File, r.config.KeyPasswordFile}
+
+	if r.config.CADir != "" {
+		if entries, err := os.ReadDir(r.config.CADir); err == nil {
+			for _, entry := range entries {
+				files = append(files, filepath.Join(r.config.CADir, entry.Name()))
+			}
+		}
+	}
+
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+
+		// Stat follows symlinks, so Kubernetes-style atomic symlink swaps are noticed
+		if info, err := os.Stat(file); err == nil {
+			stamps[file] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		} else {
+			stamps[file] = fileStamp{}
+		}
+	}
+
+	return stamps
+}
+
+// getClientCertificate returns the current client certificate, or none
+func (r *tlsReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if certificate := r.Material().certificate; certificate != nil {
+		return certificate, nil
+	}
+
+	return &tls.Certificate{}, nil
+}
+
+// UnobservedTLSConfig creates a client TLS configuration like TLSConfig whose
+// handshakes aren't reported to onVerify and onConnection, for connections
+// besides the one the callbacks describe
+func (r *tlsReloader) UnobservedTLSConfig() *tls.Config {
+	config := r.TLSConfig()
+	config.VerifyConnection = nil
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if _, err := r.verifyRawCertificates(rawCerts); err != nil && !r.config.InsecureSkipVerify {
+			return err
+		}
+
+		return nil
+	}
+
+	return config
+}
+
+// verifyPeerCertificate verifies the broker certificate chain against the
+// current CA pool (or the system roots) and the expected server name. With
+// insecure_skip_verify the chain is still verified and reported, but accepted.
+func (r *tlsReloader) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	chain, err := r.verifyRawCertificates(rawCerts)
+
+	if r.onVerify != nil {
+		r.onVerify(chain, err)
+	}
+
+	if r.config.InsecureSkipVerify {
+		return nil
+	}
+
+	return err
+}
+
+// verifyConnection reports the negotiated connection; all checks are done in verifyPeerCertificate
+func (r *tlsReloader) verifyConnection(state tls.ConnectionState) error {
+	if r.onConnection != nil {
+		r.onConnection(state)
+	}
+
+	return nil
+}
+
+// verifyRawCertificates parses and verifies the DER chain presented by the
+// broker, returning the chain if it could be parsed
+func (r *tlsReloader) verifyRawCertificates(rawCerts [][]byte) ([]*x509.Certificate, error) {
+	chain, err := parseCertificates(rawCerts)
+	if err != nil {
+		return nil, err
+	}
+
+	return chain, r.verify(chain)
+}
+
+// verify verifies the chain presented by the broker
+func (r *tlsReloader) verify(chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return errors.New("broker sent no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	serverName := r.serverName
+	if r.config.ServerName != "" {
+		serverName = r.config.ServerName
+	}
+
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         r.Material().roots,
+		Intermediates: intermediates,
+		DNSName:       serverName,
+	})
+
+	return err
+}
+
+// parseCertificates parses the DER certificates sent by the broker
+func parseCertificates(rawCerts [][]byte) ([]*x509.Certificate, error) {
+	chain := make([]*x509.Certificate, 0, len(rawCerts))
+
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parse broker certificate: %w", err)
+		}
+
+		chain = append(chain, cert)
+	}
+
+	return chain, nil
+}
+
+// verifyErrorReason returns a short label value describing why a broker
+// certificate failed verification
+func verifyErrorReason(err error) string {
+	var (
+		unknownCA   x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		invalidErr  x509.CertificateInvalidError
+	)
+
+	switch {
+	case errors.As(err, &unknownCA):
+		return "unknown_authority"
+	case errors.As(err, &hostnameErr):
+		return "hostname_mismatch"
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return "expired"
+	case errors.As(err, &invalidErr):
+		return "invalid"
+	default:
+		return "other"
+	}
+}
+
+// certificateSANs lists the subject alternative names of a certificate
+func certificateSANs(cert *x509.Certificate) string {
+	sans := slices.Clone(cert.DNSNames)
+
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+
+	sans = append(sans, cert.EmailAddresses...)
+
+	return strings.Join(sans, ",")
+}
+
+// loadCertPool reads the PEM certificates in caFile and every file in caDir.
+// The pool replaces the system roots, like Mosquitto's cafile and capath.
+func loadCertPool(caFile, caDir string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+		}
+	}
+
+	if caDir != "" {
+		entries, err := os.ReadDir(caDir)
+		if err != nil {
+			return nil, fmt.Errorf("read CA directory: %w", err)
+		}
+
+		found := false
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+
+			pem, err := os.ReadFile(filepath.Join(caDir, entry.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("read CA directory: %w", err)
+			}
+
+			// Skip files that aren't PEM certificates, such as CRLs
+			if pool.AppendCertsFromPEM(pem) {
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("no certificates found in CA directory %s", caDir)
+		}
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// topicGroupQoS is the QoS topic groups are subscribed with. Messages are
+// delivered with the lower of the publisher's and the subscription's QoS,
+// so only the maximum shows the QoS they were published with. Group topics
+// covered by a lower QoS subscription are received at that QoS instead, and
+// counted without a QoS.
+const topicGroupQoS = 2
+
+// topicGroupCappedQoS indexes the messages received through a subscription
+// with a lower QoS than topicGroupQoS, whose published QoS is unknown
+const topicGroupCappedQoS = 3
+
+// topicGroup records the distributions of messages on a named set of
+// application topics, as received from one broker
+type topicGroup struct {
+	name    string
+	filters []string
+	metrics *topicGroupMetrics
+
+	// lastArrival is when the last message that wasn't a retained message
+	// was received, in Unix nanoseconds; 0 after connecting
+	lastArrival atomic.Int64
+
+	// capped are the filters of the group that are covered by a subscription
+	// with a lower QoS than topicGroupQoS
+	capped atomic.Pointer[[]string]
+}
+
+// topicGroupMetrics are the metrics of a topic group for one broker, looked
+// up once so recording a message doesn't hash label values
+type topicGroupMetrics struct {
+	payloadSize  prometheus.Observer
+	interarrival prometheus.Observer
+	// messages is indexed by QoS, or topicGroupCappedQoS, and retain flag
+	messages [4][2]prometheus.Counter
+}
+
+// newTopicGroups creates the topic groups of a broker
+func newTopicGroups(cfgs []TopicGroupConfig, labelValues []string, metrics *MosquittoMetrics) []*topicGroup {
+	groups := make([]*topicGroup, 0, len(cfgs))
+
+	for _, cfg := range cfgs {
+		groups = append(groups, &topicGroup{
+			name:    cfg.Name,
+			filters: cfg.Topics,
+			metrics: metrics.TopicGroupMetrics(labelValues, cfg.Name),
+		})
+	}
+
+	return groups
+}
+
+// validateTopicGroups checks the topic group configuration. Errors start
+// with the index of the offending group.
+func validateTopicGroups(cfgs []TopicGroupConfig) error {
+	names := make(map[string]bool, len(cfgs))
+
+	for i, cfg := range cfgs {
+		if cfg.Name == "" {
+			return fmt.Errorf("[%d].name is required", i)
+		}
+
+		if names[cfg.Name] {
+			return fmt.Errorf("[%d].name: duplicate topic group %q", i, cfg.Name)
+		}
+
+		names[cfg.Name] = true
+
+		if len(cfg.Topics) == 0 {
+			return fmt.Errorf("[%d].topics: at least one topic filter is required", i)
+		}
+
+		for j, filter := range cfg.Topics {
+			if err := validateTopicFilter(filter); err != nil {
+				return fmt.Errorf("[%d].topics[%d]: %w", i, j, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Matches returns true if topic belongs to the group
+func (g *topicGroup) Matches(topic string) bool {
+	return matchesAnyFilter(g.filters, topic)
+}
+
+// Record records a message received at now
+func (g *topicGroup) Record(msg mqtt.Message, now time.Time) {
+	retained := 0
+	if msg.Retained() {
+		retained = 1
+	}
+
+	qos := min(msg.Qos(), 2)
+	if capped := g.capped.Load(); capped != nil && matchesAnyFilter(*capped, msg.Topic()) {
+		qos = topicGroupCappedQoS
+	}
+
+	g.metrics.messages[qos][retained].Inc()
+	g.metrics.payloadSize.Observe(float64(len(msg.Payload())))
+
+	// Retained messages are replayed on subscribing rather than arriving
+	if retained == 1 {
+		return
+	}
+
+	if last := g.lastArrival.Swap(now.UnixNano()); last != 0 {
+		g.metrics.interarrival.Observe(now.Sub(time.Unix(0, last)).Seconds())
+	}
+}
+
+// SetSubscriptions records which filters of the group are received through
+// a subscription with a lower QoS, given the filters subscribed to
+func (g *topicGroup) SetSubscriptions(subscriptions map[string]byte) {
+	var capped []string
+
+	for _, filter := range g.filters {
+		covered := false
+
+		for other, qos := range subscriptions {
+			if qos >= topicGroupQoS && filterCovers(other, filter) {
+				covered = true
+				break
+			}
+		}
+
+		if !covered {
+			capped = append(capped, filter)
+		}
+	}
+
+	g.capped.Store(&capped)
+}
+
+// Reset forgets the last arrival, so the gap across a reconnect isn't
+// recorded as an inter-arrival time
+func (g *topicGroup) Reset() {
+	g.lastArrival.Store(0)
+}
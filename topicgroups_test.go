@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTopicGroupCappedQoS(t *testing.T) {
+	tests := []struct {
+		name          string
+		subscriptions map[string]byte
+		wantQoS       string
+	}{
+		{
+			name:          "own subscription",
+			subscriptions: map[string]byte{"tenants/+/telemetry": topicGroupQoS, "other/#": 0},
+			wantQoS:       "1",
+		},
+		{
+			name:          "covered by a group filter",
+			subscriptions: map[string]byte{"tenants/#": topicGroupQoS},
+			wantQoS:       "1",
+		},
+		{
+			name:          "covered by a lower QoS subscription",
+			subscriptions: map[string]byte{"#": 0},
+			wantQoS:       "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := NewProbeMetrics(prometheus.NewRegistry(), NamingLegacy)
+			groups := newTopicGroups([]TopicGroupConfig{{Name: "g", Topics: []string{"tenants/+/telemetry"}}}, []string{"b"}, metrics)
+
+			groups[0].SetSubscriptions(tt.subscriptions)
+			groups[0].Record(&testMessage{topic: "tenants/a/telemetry", qos: 1}, time.Now())
+
+			if got := testutil.ToFloat64(metrics.topicGroupMessages.WithLabelValues("b", "g", tt.wantQoS, "false")); got != 1 {
+				t.Errorf("qos=%q counted %g messages, want 1", tt.wantQoS, got)
+			}
+		})
+	}
+}
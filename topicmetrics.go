@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Topic metric types
+const (
+	topicMetricGauge   = "gauge"
+	topicMetricCounter = "counter"
+)
+
+// metricNamePattern matches valid Prometheus metric names
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// topicRule maps messages on application topics matching a topic filter to
+// a metric, see TopicMetricConfig
+type topicRule struct {
+	// filter is the topic filter subscribed to, with the label names removed
+	filter   string
+	segments []string
+	selector []selectorStep
+	metric   topicMetric
+}
+
+// selectorStep is a step into a JSON document: an object key or array index
+type selectorStep struct {
+	key   string
+	index int // used if key is empty
+}
+
+// newTopicRules compiles the topic metric rules. labelNames are the broker
+// labels, which rules can't use for topic levels. Errors start with the
+// index of the offending rule.
+func newTopicRules(cfgs []TopicMetricConfig, labelNames []string) ([]*topicRule, error) {
+	rules := make([]*topicRule, 0, len(cfgs))
+
+	for i, cfg := range cfgs {
+		rule, err := newTopicRule(cfg, labelNames)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]%w", i, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// newTopicRule compiles a single topic metric rule
+func newTopicRule(cfg TopicMetricConfig, labelNames []string) (*topicRule, error) {
+	if !metricNamePattern.MatchString(cfg.Metric) {
+		return nil, fmt.Errorf(".metric: invalid metric name %q", cfg.Metric)
+	}
+
+	rule := &topicRule{
+		segments: strings.Split(cfg.Topic, "/"),
+		metric:   topicMetric{Name: cfg.Metric, Help: cfg.Help},
+	}
+
+	switch cfg.Type {
+	case "", topicMetricGauge:
+	case topicMetricCounter:
+		rule.metric.Counter = true
+	default:
+		return nil, fmt.Errorf(".type must be %q or %q, got %q", topicMetricGauge, topicMetricCounter, cfg.Type)
+	}
+
+	if cfg.Topic == "" {
+		return nil, errors.New(".topic is required")
+	}
+
+	// $SYS topics are handled by their own pipeline
+	if strings.HasPrefix(cfg.Topic, "$") {
+		return nil, fmt.Errorf(".topic: %q is a $ topic, which topic metrics can't be used for", cfg.Topic)
+	}
+
+	levels := make([]string, len(rule.segments))
+
+	for i, segment := range rule.segments {
+		switch {
+		case strings.HasPrefix(segment, "+"), strings.HasPrefix(segment, "#"):
+			if segment[0] == '#' && i != len(rule.segments)-1 {
+				return nil, fmt.Errorf(".topic: %q may only use # as the last level", cfg.Topic)
+			}
+
+			levels[i] = segment[:1]
+
+			name := segment[1:]
+			if name == "" {
+				continue
+			}
+
+			if !labelNamePattern.MatchString(name) {
+				return nil, fmt.Errorf(".topic: invalid label name %q", name)
+			}
+
+			if slices.Contains(labelNames, name) || slices.Contains(rule.metric.LabelNames, name) {
+				return nil, fmt.Errorf(".topic: label name %q is already in use", name)
+			}
+
+			rule.metric.LabelNames = append(rule.metric.LabelNames, name)
+		case strings.ContainsAny(segment, "+#"):
+			return nil, fmt.Errorf(".topic: %q has a wildcard that isn't a whole level", cfg.Topic)
+		default:
+			levels[i] = segment
+		}
+	}
+
+	rule.filter = strings.Join(levels, "/")
+
+	if rule.metric.Help == "" {
+		rule.metric.Help = "Value of the payload of MQTT topic " + rule.filter
+		if cfg.Value != "" {
+			rule.metric.Help = fmt.Sprintf("Value of %s in the payload of MQTT topic %s", cfg.Value, rule.filter)
+		}
+	}
+
+	selector, err := parseSelector(cfg.Value)
+	if err != nil {
+		return nil, fmt.Errorf(".value: %w", err)
+	}
+
+	rule.selector = selector
+
+	return rule, nil
+}
+
+// Match returns the metric for topic, with the values of the labels taken
+// from its levels, if it matches the rule's filter
+func (r *topicRule) Match(topic string) (topicMetric, bool) {
+	// Most messages don't match, so check before splitting the topic
+	if !topicMatchesFilter(r.filter, topic) {
+		return topicMetric{}, false
+	}
+
+	metric := r.metric
+	if len(metric.LabelNames) == 0 {
+		return metric, true
+	}
+
+	levels := strings.Split(topic, "/")
+	metric.LabelValues = make([]string, 0, len(metric.LabelNames))
+
+	for i, segment := range r.segments {
+		switch {
+		case len(segment) < 2:
+		case segment[0] == '+':
+			metric.LabelValues = append(metric.LabelValues, levels[i])
+		case segment[0] == '#':
+			metric.LabelValues = append(metric.LabelValues, strings.Join(levels[min(i, len(levels)):], "/"))
+		}
+	}
+
+	return metric, true
+}
+
+// Value extracts the rule's value from a message payload
+func (r *topicRule) Value(payload *jsonPayload) (float64, error) {
+	if r.selector == nil {
+		value, err := parseTopicNumber(string(payload.raw))
+		if err != nil {
+			return 0, errors.New("payload is not a number")
+		}
+
+		return value, nil
+	}
+
+	node, err := payload.Select(r.selector)
+	if err != nil {
+		return 0, err
+	}
+
+	switch value := node.(type) {
+	case float64:
+		return value, nil
+	case bool:
+		if value {
+			return 1, nil
+		}
+
+		return 0, nil
+	case string:
+		if number, err := parseTopicNumber(value); err == nil {
+			return number, nil
+		}
+
+		return 0, fmt.Errorf("string %q is not a number", value)
+	default:
+		return 0, fmt.Errorf("selected %T is not a number", node)
+	}
+}
+
+// parseTopicNumber parses an application payload that must be a number as a
+// whole. Unlike $SYS payloads, it may carry a sign or an exponent, and
+// anything else is an error rather than skipped.
+func parseTopicNumber(s string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSpace(s), 64)
+}
+
+// String formats the step as in a JSONPath
+func (s selectorStep) String() string {
+	if s.key == "" {
+		return fmt.Sprintf("[%d]", s.index)
+	}
+
+	return "." + s.key
+}
+
+// parseSelector parses a JSONPath of object fields and array indexes, such as
+// $.sensors[0].value or ["field name"], or the same without the leading "$",
+// e.g. sensors[0].value. An empty selector selects nothing and returns nil.
+func parseSelector(selector string) ([]selectorStep, error) {
+	if selector == "" {
+		return nil, nil
+	}
+
+	path := strings.TrimPrefix(selector, "$")
+	steps := []selectorStep{}
+
+	// A path without "$" may start with a field name
+	if path != "" && path[0] != '.' && path[0] != '[' {
+		path = "." + path
+	}
+
+	for path != "" {
+		switch path[0] {
+		case '.':
+			end := strings.IndexAny(path[1:], ".[") + 1
+			if end == 0 {
+				end = len(path)
+			}
+
+			if end == 1 {
+				return nil, fmt.Errorf("empty field name in %q", selector)
+			}
+
+			steps = append(steps, selectorStep{key: path[1:end]})
+			path = path[end:]
+		case '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in %q", selector)
+			}
+
+			inner := path[1:end]
+			path = path[end+1:]
+
+			if key, err := strconv.Unquote(strings.ReplaceAll(inner, "'", `"`)); err == nil && len(inner) >= 2 {
+				steps = append(steps, selectorStep{key: key})
+				continue
+			}
+
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index [%s] in %q", inner, selector)
+			}
+
+			steps = append(steps, selectorStep{index: index})
+		default:
+			return nil, fmt.Errorf("unexpected %q in %q", path[0], selector)
+		}
+	}
+
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%q selects nothing", selector)
+	}
+
+	return steps, nil
+}
+
+// jsonPayload is a message payload that is decoded as JSON on first use, so
+// that several rules matching a message share the work
+type jsonPayload struct {
+	raw     []byte
+	decoded bool
+	doc     any
+	err     error
+}
+
+// Document returns the decoded payload
+func (p *jsonPayload) Document() (any, error) {
+	if !p.decoded {
+		p.decoded = true
+		if err := json.Unmarshal(p.raw, &p.doc); err != nil {
+			p.err = fmt.Errorf("payload is not JSON: %w", err)
+		}
+	}
+
+	return p.doc, p.err
+}
+
+// Select returns the value the selector selects in the decoded payload
+func (p *jsonPayload) Select(selector []selectorStep) (any, error) {
+	node, err := p.Document()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, step := range selector {
+		switch current := node.(type) {
+		case map[string]any:
+			if step.key == "" {
+				return nil, fmt.Errorf("no index [%d] in an object", step.index)
+			}
+
+			var ok bool
+			if node, ok = current[step.key]; !ok {
+				return nil, fmt.Errorf("no field %q", step.key)
+			}
+		case []any:
+			if step.key != "" {
+				return nil, fmt.Errorf("no field %q in an array", step.key)
+			}
+
+			if step.index >= len(current) {
+				return nil, fmt.Errorf("index [%d] out of range", step.index)
+			}
+
+			node = current[step.index]
+		default:
+			return nil, fmt.Errorf("can't select %s from a %T", step, node)
+		}
+	}
+
+	return node, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNewTopicRuleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  TopicMetricConfig
+	}{
+		{"invalid metric name", TopicMetricConfig{Topic: "a", Metric: "a-b"}},
+		{"unknown type", TopicMetricConfig{Topic: "a", Metric: "a", Type: "histogram"}},
+		{"missing topic", TopicMetricConfig{Metric: "a"}},
+		{"$ topic", TopicMetricConfig{Topic: "$SYS/#", Metric: "a"}},
+		{"# before the last level", TopicMetricConfig{Topic: "a/#/b", Metric: "a"}},
+		{"partial wildcard level", TopicMetricConfig{Topic: "a/b+", Metric: "a"}},
+		{"invalid label name", TopicMetricConfig{Topic: "a/+1x", Metric: "a"}},
+		{"broker label name", TopicMetricConfig{Topic: "a/+broker", Metric: "a"}},
+		{"duplicate label name", TopicMetricConfig{Topic: "+x/+x", Metric: "a"}},
+		{"invalid selector", TopicMetricConfig{Topic: "a", Metric: "a", Value: "$.a[x]"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTopicRule(tt.cfg, []string{"broker"}); err == nil {
+				t.Errorf("newTopicRule(%+v) succeeded", tt.cfg)
+			}
+		})
+	}
+}
+
+func TestTopicRuleMatch(t *testing.T) {
+	tests := []struct {
+		filter     string
+		topic      string
+		wantMatch  bool
+		wantFilter string
+		wantNames  []string
+		wantValues []string
+	}{
+		{"sensors/temp", "sensors/temp", true, "sensors/temp", nil, nil},
+		{"sensors/temp", "sensors/humidity", false, "sensors/temp", nil, nil},
+		{"sensors/+room/temp", "sensors/kitchen/temp", true, "sensors/+/temp", []string{"room"}, []string{"kitchen"}},
+		{"sensors/+/temp", "sensors/kitchen/temp", true, "sensors/+/temp", nil, nil},
+		{"+site/+room", "berlin/kitchen", true, "+/+", []string{"site", "room"}, []string{"berlin", "kitchen"}},
+		{"devices/#path", "devices/a/b/c", true, "devices/#", []string{"path"}, []string{"a/b/c"}},
+		{"devices/#path", "devices", true, "devices/#", []string{"path"}, []string{""}},
+		{"devices/+id/#rest", "devices/x/y", true, "devices/+/#", []string{"id", "rest"}, []string{"x", "y"}},
+		{"devices/+id", "other/x", false, "devices/+", []string{"id"}, nil},
+	}
+
+	for _, tt := range tests {
+		rule, err := newTopicRule(TopicMetricConfig{Topic: tt.filter, Metric: "m"}, []string{"broker"})
+		if err != nil {
+			t.Fatalf("newTopicRule(%q): %v", tt.filter, err)
+		}
+
+		if rule.filter != tt.wantFilter {
+			t.Errorf("filter of %q = %q, want %q", tt.filter, rule.filter, tt.wantFilter)
+		}
+
+		metric, ok := rule.Match(tt.topic)
+		if ok != tt.wantMatch {
+			t.Errorf("%q matches %q = %t, want %t", tt.filter, tt.topic, ok, tt.wantMatch)
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		if !slices.Equal(metric.LabelNames, tt.wantNames) || !slices.Equal(metric.LabelValues, tt.wantValues) {
+			t.Errorf("%q on %q: labels %v = %v, want %v = %v", tt.filter, tt.topic,
+				metric.LabelNames, metric.LabelValues, tt.wantNames, tt.wantValues)
+		}
+	}
+}
+
+func TestTopicRuleValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		payload string
+		want    float64
+		wantErr bool
+	}{
+		{name: "plain number", payload: "21.5", want: 21.5},
+		{name: "plain negative integer", payload: "-5", want: -5},
+		{name: "plain negative decimal", payload: "-5.5", want: -5.5},
+		{name: "plain exponent", payload: "1e3", want: 1000},
+		{name: "plain surrounding whitespace", payload: " 42\n", want: 42},
+		{name: "plain trailing text", payload: "42 C", wantErr: true},
+		{name: "plain version", payload: "v2.1", wantErr: true},
+		{name: "plain empty", payload: "", wantErr: true},
+		{name: "field number", value: "$.t", payload: `{"t":-5}`, want: -5},
+		{name: "field numeric string", value: "t", payload: `{"t":"-5"}`, want: -5},
+		{name: "field exponent string", value: "t", payload: `{"t":"1e3"}`, want: 1000},
+		{name: "field non-numeric string", value: "t", payload: `{"t":"warm"}`, wantErr: true},
+		{name: "field true", value: "on", payload: `{"on":true}`, want: 1},
+		{name: "field false", value: "on", payload: `{"on":false}`, want: 0},
+		{name: "field null", value: "t", payload: `{"t":null}`, wantErr: true},
+		{name: "field object", value: "t", payload: `{"t":{}}`, wantErr: true},
+		{name: "missing field", value: "t", payload: `{"u":1}`, wantErr: true},
+		{name: "nested index", value: "$.sensors[1].value", payload: `{"sensors":[{"value":1},{"value":-2.5}]}`, want: -2.5},
+		{name: "index out of range", value: "$.sensors[2]", payload: `{"sensors":[1,2]}`, wantErr: true},
+		{name: "quoted field", value: `$["field name"]`, payload: `{"field name":3}`, want: 3},
+		{name: "not JSON", value: "t", payload: "21.5", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := newTopicRule(TopicMetricConfig{Topic: "a", Metric: "m", Value: tt.value}, nil)
+			if err != nil {
+				t.Fatalf("newTopicRule: %v", err)
+			}
+
+			got, err := rule.Value(&jsonPayload{raw: []byte(tt.payload)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Value(%q) error = %v, want error %t", tt.payload, err, tt.wantErr)
+			}
+
+			if err == nil && got != tt.want {
+				t.Errorf("Value(%q) = %g, want %g", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// trafficOtherPrefix is the prefix traffic is accounted to once a broker has
+// reached the maximum number of prefixes
+const trafficOtherPrefix = "other"
+
+// Traffic accounting metric names
+const (
+	topicMessagesMetricName = "mosquitto_topic_messages_total"
+	topicMessagesMetricHelp = "Total number of messages received on application topics, excluding retained messages, by topic prefix"
+	topicBytesMetricName    = "mosquitto_topic_bytes_total"
+	topicBytesMetricHelp    = "Total number of payload bytes received on application topics, excluding retained messages, by topic prefix"
+	topicPrefixesMetricName = "mosquitto_exporter_topic_prefixes"
+	topicPrefixesMetricHelp = "Number of topic prefixes traffic is accounted to, including other"
+)
+
+// trafficCounter holds the totals of a topic prefix
+type trafficCounter struct {
+	messages atomic.Uint64
+	bytes    atomic.Uint64
+}
+
+// trafficAccount aggregates the messages and payload bytes received from a
+// broker by topic prefix. Once a prefix is known, recording a message takes
+// a read lock and two atomic adds and doesn't allocate.
+type trafficAccount struct {
+	filters     []string
+	depth       int
+	maxPrefixes int
+
+	mu       sync.RWMutex
+	prefixes map[string]*trafficCounter
+
+	// other is set before full, and used for new prefixes once it is
+	other *trafficCounter
+	full  atomic.Bool
+}
+
+// newTrafficAccount creates an account of the traffic on topics matching
+// filters, by their first depth levels, for at most maxPrefixes prefixes
+func newTrafficAccount(filters []string, depth, maxPrefixes int) *trafficAccount {
+	account := &trafficAccount{
+		depth:       depth,
+		maxPrefixes: maxPrefixes,
+		prefixes:    make(map[string]*trafficCounter),
+	}
+
+	// Messages on every topic are accounted without matching them
+	for _, filter := range filters {
+		if filter == "#" {
+			return account
+		}
+	}
+
+	account.filters = filters
+
+	return account
+}
+
+// Record accounts a message with a payload of size bytes on topic, if it
+// matches the account's filters
+func (a *trafficAccount) Record(topic string, size int) {
+	if a.filters != nil && !matchesAnyFilter(a.filters, topic) {
+		return
+	}
+
+	prefix := topicPrefix(topic, a.depth)
+
+	a.mu.RLock()
+	counter, ok := a.prefixes[prefix]
+	a.mu.RUnlock()
+
+	switch {
+	case ok:
+	case a.full.Load():
+		counter = a.other
+	default:
+		counter = a.add(prefix)
+	}
+
+	counter.messages.Add(1)
+	counter.bytes.Add(uint64(size)) //nolint:gosec // payload sizes are never negative
+}
+
+// add returns the counter of a prefix that wasn't known, creating it unless
+// the account is full
+func (a *trafficAccount) add(prefix string) *trafficCounter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if counter, ok := a.prefixes[prefix]; ok {
+		return counter
+	}
+
+	if a.full.Load() {
+		return a.other
+	}
+
+	// The prefix shares memory with the topic, which may be much longer
+	counter := &trafficCounter{}
+	a.prefixes[strings.Clone(prefix)] = counter
+
+	// Keep a slot for other; a topic prefix of that name shares it
+	if len(a.prefixes) >= a.maxPrefixes-1 {
+		if a.other = a.prefixes[trafficOtherPrefix]; a.other == nil {
+			a.other = &trafficCounter{}
+			a.prefixes[trafficOtherPrefix] = a.other
+		}
+
+		a.full.Store(true)
+	}
+
+	return counter
+}
+
+// collect sends the account's metrics with the given broker label values
+func (a *trafficAccount) collect(ch chan<- prometheus.Metric, tc *trafficCollector, labelValues []string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for prefix, counter := range a.prefixes {
+		values := append(append([]string{}, labelValues...), prefix)
+		ch <- prometheus.MustNewConstMetric(tc.messages, prometheus.CounterValue, float64(counter.messages.Load()), values...)
+		ch <- prometheus.MustNewConstMetric(tc.bytes, prometheus.CounterValue, float64(counter.bytes.Load()), values...)
+	}
+
+	ch <- prometheus.MustNewConstMetric(tc.prefixes, prometheus.GaugeValue, float64(len(a.prefixes)), labelValues...)
+}
+
+// trafficCollector exports the traffic accounts of all brokers
+type trafficCollector struct {
+	messages *prometheus.Desc
+	bytes    *prometheus.Desc
+	prefixes *prometheus.Desc
+
+	mu       sync.RWMutex
+	accounts []brokerTrafficAccount
+}
+
+// brokerTrafficAccount is the traffic account of a broker
+type brokerTrafficAccount struct {
+	labelValues []string
+	account     *trafficAccount
+}
+
+// newTrafficCollector creates a collector for accounts of brokers with the given label names
+func newTrafficCollector(labelNames []string) *trafficCollector {
+	prefixLabelNames := append(append([]string{}, labelNames...), "prefix")
+
+	return &trafficCollector{
+		messages: prometheus.NewDesc(topicMessagesMetricName, topicMessagesMetricHelp, prefixLabelNames, nil),
+		bytes:    prometheus.NewDesc(topicBytesMetricName, topicBytesMetricHelp, prefixLabelNames, nil),
+		prefixes: prometheus.NewDesc(topicPrefixesMetricName, topicPrefixesMetricHelp, labelNames, nil),
+	}
+}
+
+// Add exports the traffic account of a broker
+func (tc *trafficCollector) Add(labelValues []string, account *trafficAccount) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.accounts = append(tc.accounts, brokerTrafficAccount{labelValues: labelValues, account: account})
+}
+
+// Describe implements prometheus.Collector
+func (tc *trafficCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tc.messages
+	ch <- tc.bytes
+	ch <- tc.prefixes
+}
+
+// Collect implements prometheus.Collector
+func (tc *trafficCollector) Collect(ch chan<- prometheus.Metric) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+
+	for _, broker := range tc.accounts {
+		broker.account.collect(ch, tc, broker.labelValues)
+	}
+}
+
+// topicPrefix returns the first depth levels of topic, or all of it if it
+// has fewer levels
+func topicPrefix(topic string, depth int) string {
+	end := 0
+
+	for range depth {
+		i := strings.IndexByte(topic[end:], '/')
+		if i < 0 {
+			return topic
+		}
+
+		end += i + 1
+	}
+
+	return topic[:end-1]
+}
+
+// matchesAnyFilter returns true if topic matches one of the topic filters
+func matchesAnyFilter(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if topicMatchesFilter(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// topicMatchesFilter returns true if topic matches the MQTT topic filter.
+// It walks both level by level without allocating.
+func topicMatchesFilter(filter, topic string) bool {
+	if skipsDollarTopic(filter, topic) {
+		return false
+	}
+
+	for {
+		filterLevel, filterRest, filterMore := strings.Cut(filter, "/")
+		if filterLevel == "#" {
+			return true
+		}
+
+		topicLevel, topicRest, topicMore := strings.Cut(topic, "/")
+		if filterLevel != "+" && filterLevel != topicLevel {
+			return false
+		}
+
+		switch {
+		case !filterMore && !topicMore:
+			return true
+		case !topicMore:
+			// "a/#" also matches "a"
+			return filterRest == "#"
+		case !filterMore:
+			return false
+		}
+
+		filter, topic = filterRest, topicRest
+	}
+}
+
+// filterCovers returns true if every topic matching filter b also matches
+// filter a, so subscribing to both would only deliver duplicates
+func filterCovers(a, b string) bool {
+	if skipsDollarTopic(a, b) {
+		return false
+	}
+
+	for {
+		aLevel, aRest, aMore := strings.Cut(a, "/")
+		if aLevel == "#" {
+			return true
+		}
+
+		bLevel, bRest, bMore := strings.Cut(b, "/")
+		if bLevel == "#" || (aLevel != "+" && aLevel != bLevel) {
+			return false
+		}
+
+		if !aMore || !bMore {
+			// "a/#" also covers "a"
+			return (!aMore && !bMore) || (aMore && aRest == "#")
+		}
+
+		a, b = aRest, bRest
+	}
+}
+
+// skipsDollarTopic returns true if topic (or a filter compared with filter)
+// starts with $ and filter with a wildcard level, which doesn't match $
+// topics like $SYS
+func skipsDollarTopic(filter, topic string) bool {
+	return strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#"))
+}
+
+// minimalSubscriptions drops the filters of subscriptions that are covered
+// by another one. The remaining filters keep their own QoS, even if they
+// cover a filter with a higher one: raising a broad filter such as # to QoS 2
+// would put every message on the broker through the QoS 2 flow.
+func minimalSubscriptions(subscriptions map[string]byte) map[string]byte {
+	minimal := make(map[string]byte, len(subscriptions))
+
+	for filter, qos := range subscriptions {
+		covered := false
+
+		for other := range subscriptions {
+			if other != filter && filterCovers(other, filter) {
+				covered = true
+				break
+			}
+		}
+
+		if !covered {
+			minimal[filter] = qos
+		}
+	}
+
+	return minimal
+}
+
+// validateTopicFilter checks that filter is a valid filter for application topics
+func validateTopicFilter(filter string) error {
+	if filter == "" {
+		return errors.New("empty topic filter")
+	}
+
+	// $SYS topics are handled by their own pipeline
+	if strings.HasPrefix(filter, "$") {
+		return fmt.Errorf("%q is a $ topic, which only $SYS metrics can use", filter)
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("%q may only use # as the last level", filter)
+		}
+
+		if level != "+" && level != "#" && strings.ContainsAny(level, "+#") {
+			return fmt.Errorf("%q has a wildcard that isn't a whole level", filter)
+		}
+	}
+
+	return nil
+}
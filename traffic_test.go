@@ -0,0 +1,215 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestTopicMatchesFilter(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a", false},
+		{"a", "a/b", false},
+		{"a/b", "a/b/c", false},
+
+		// Single-level wildcard
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+", "a", false},
+		{"a/+", "a/", true},
+		{"+/b", "a/b", true},
+		{"+/+", "/b", true},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"+", "a", true},
+		{"+", "a/b", false},
+
+		// Multi-level wildcard, including the parent level
+		{"#", "a", true},
+		{"#", "a/b/c", true},
+		{"#", "/", true},
+		{"a/#", "a", true},
+		{"a/#", "a/", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "ab", false},
+		{"a/#", "b/a", false},
+		{"a/b/#", "a", false},
+		{"a/+/#", "a", false},
+		{"a/+/#", "a/b", true},
+		{"+/#", "a", true},
+
+		// Wildcards in the first level don't match $ topics
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"+", "$SYS", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+		{"a/#", "a/$b", true},
+	}
+
+	for _, tt := range tests {
+		if got := topicMatchesFilter(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("topicMatchesFilter(%q, %q) = %t, want %t", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestFilterCovers(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"#", "a/b", true},
+		{"#", "#", true},
+		{"#", "+/#", true},
+		{"+", "a", true},
+		{"+", "+", true},
+		{"a", "+", false},
+		{"+", "a/b", false},
+		{"+/#", "a", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a/+", true},
+		{"a/#", "a/#", true},
+		{"a/#", "#", false},
+		{"a/#", "b", false},
+		{"a/+", "a/#", false},
+		{"a/+", "a", false},
+		{"a/+/#", "a", false},
+		{"a/+/#", "a/b", true},
+		{"a/b", "a/b/#", false},
+		{"a/b/#", "a/+/c", false},
+		{"#", "$SYS/#", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+	}
+
+	for _, tt := range tests {
+		if got := filterCovers(tt.a, tt.b); got != tt.want {
+			t.Errorf("filterCovers(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMinimalSubscriptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		subscriptions map[string]byte
+		want          map[string]byte
+	}{
+		{
+			name:          "disjoint filters are kept",
+			subscriptions: map[string]byte{"a/#": 0, "b/+": 2},
+			want:          map[string]byte{"a/#": 0, "b/+": 2},
+		},
+		{
+			name:          "covered filters are dropped",
+			subscriptions: map[string]byte{"#": 0, "a/b": 0, "c/+/d": 0},
+			want:          map[string]byte{"#": 0},
+		},
+		{
+			name:          "parent level is covered",
+			subscriptions: map[string]byte{"a/#": 0, "a": 0},
+			want:          map[string]byte{"a/#": 0},
+		},
+		{
+			name:          "covering filter keeps its own QoS",
+			subscriptions: map[string]byte{"#": 0, "tenants/+/telemetry": 2},
+			want:          map[string]byte{"#": 0},
+		},
+		{
+			name:          "covered filter with lower QoS",
+			subscriptions: map[string]byte{"a/#": 2, "a/b": 0},
+			want:          map[string]byte{"a/#": 2},
+		},
+		{
+			name:          "partially overlapping filters are kept",
+			subscriptions: map[string]byte{"a/+": 0, "+/b": 1},
+			want:          map[string]byte{"a/+": 0, "+/b": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := minimalSubscriptions(tt.subscriptions); !maps.Equal(got, tt.want) {
+				t.Errorf("minimalSubscriptions(%v) = %v, want %v", tt.subscriptions, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopicPrefix(t *testing.T) {
+	tests := []struct {
+		topic string
+		depth int
+		want  string
+	}{
+		{"a/b/c", 1, "a"},
+		{"a/b/c", 2, "a/b"},
+		{"a/b/c", 3, "a/b/c"},
+		{"a/b/c", 4, "a/b/c"},
+		{"a", 2, "a"},
+		{"/a/b", 1, ""},
+		{"/a/b", 2, "/a"},
+		{"a//b", 2, "a/"},
+		{"a/b/", 2, "a/b"},
+	}
+
+	for _, tt := range tests {
+		if got := topicPrefix(tt.topic, tt.depth); got != tt.want {
+			t.Errorf("topicPrefix(%q, %d) = %q, want %q", tt.topic, tt.depth, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		wantErr bool
+	}{
+		{"#", false},
+		{"a/+/b", false},
+		{"a/#", false},
+		{"+", false},
+		{"", true},
+		{"$SYS/#", true},
+		{"a/#/b", true},
+		{"a/b#", true},
+		{"a+/b", true},
+	}
+
+	for _, tt := range tests {
+		if err := validateTopicFilter(tt.filter); (err != nil) != tt.wantErr {
+			t.Errorf("validateTopicFilter(%q) = %v, want error %t", tt.filter, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTrafficAccountOverflow(t *testing.T) {
+	account := newTrafficAccount([]string{"tenants/#"}, 2, 3)
+
+	for _, topic := range []string{"tenants/a/x", "tenants/a/y", "tenants/b/x", "tenants/c/x", "tenants/d/x", "other/x"} {
+		account.Record(topic, 10)
+	}
+
+	want := map[string]uint64{"tenants/a": 2, "tenants/b": 1, trafficOtherPrefix: 2}
+	got := make(map[string]uint64)
+
+	for prefix, counter := range account.prefixes {
+		got[prefix] = counter.messages.Load()
+
+		if bytes := counter.bytes.Load(); bytes != got[prefix]*10 {
+			t.Errorf("prefix %q has %d bytes, want %d", prefix, bytes, got[prefix]*10)
+		}
+	}
+
+	if !maps.Equal(got, want) {
+		t.Errorf("messages by prefix = %v, want %v", got, want)
+	}
+}